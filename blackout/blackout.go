@@ -0,0 +1,105 @@
+package blackout
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"regexp"
+)
+
+// Fill is the byte which replaces matched bytes
+const Fill = '*'
+
+// KeySize is the size of the random key of a Blackouter
+const KeySize = 32
+
+type Blackouter struct {
+	rules []*Rule
+	// key is the HMAC key of Hash and pseudonyms
+	key []byte
+}
+
+// newKey returns a random key, so that hashes can not be looked up by guessing the original
+func newKey() []byte {
+	key := make([]byte, KeySize)
+	if _, err := rand.Read(key); err != nil {
+		panic(fmt.Sprintf("blackout: random key: %v", err))
+	}
+	return key
+}
+
+func NewBlackouter(searchWords []string) *Blackouter {
+	regexps := make([]*regexp.Regexp, 0, len(searchWords))
+	for _, word := range searchWords {
+		r := regexp.MustCompile(word)
+		regexps = append(regexps, r)
+	}
+	return NewBlackouterRegexps(regexps)
+}
+
+func NewBlackouterRegexps(regexps []*regexp.Regexp) *Blackouter {
+	rules := make([]*Rule, 0, len(regexps))
+	for _, r := range regexps {
+		rules = append(rules, newFillRule(r))
+	}
+	return &Blackouter{
+		rules: rules,
+		key:   newKey(),
+	}
+}
+
+// NewBlackouterRules returns the Blackouter which replaces matches of each rule by its mode
+func NewBlackouterRules(rules []*Rule) (*Blackouter, error) {
+	for i, rule := range rules {
+		if err := rule.compile(); err != nil {
+			return nil, fmt.Errorf("rules[%d]: %w", i, err)
+		}
+	}
+	return &Blackouter{
+		rules: rules,
+		key:   newKey(),
+	}, nil
+}
+
+// SetKey sets the HMAC key of Hash and pseudonyms instead of the random one.
+// The same key gives the same hashes and pseudonyms across runs.
+func (b *Blackouter) SetKey(key []byte) {
+	b.key = append(key[:0:0], key...)
+}
+
+// Hash returns the HMAC-SHA256 of original with the key.
+// Unlike a plain hash, it can not be checked against guessed secrets without the key.
+func (b *Blackouter) Hash(original []byte) []byte {
+	mac := hmac.New(sha256.New, b.key)
+	mac.Write(original)
+	return mac.Sum(nil)
+}
+
+// Match is a match replaced by Blackout
+type Match struct {
+	Rule *Rule
+	// Offset is the offset in src
+	Offset int
+	// Original is the matched bytes, which may contain replacements by the preceding rules
+	Original []byte
+}
+
+// Blackout returns the copy of src whose matches are replaced by the rules in order.
+// fn is called with each non-empty match if it is not nil.
+func (b *Blackouter) Blackout(src []byte, fn func(m Match)) []byte {
+	dest := append(src[:0:0], src...)
+	for _, rule := range b.rules {
+		for _, loc := range rule.pattern.FindAllIndex(dest, -1) {
+			match := dest[loc[0]:loc[1]]
+			if len(match) == 0 {
+				continue
+			}
+			if fn != nil {
+				fn(Match{Rule: rule, Offset: loc[0], Original: append(match[:0:0], match...)})
+			}
+			copy(match, rule.replace(match, b.key))
+		}
+	}
+	return dest
+}
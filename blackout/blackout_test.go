@@ -0,0 +1,81 @@
+package blackout
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"testing"
+)
+
+func TestReplace(t *testing.T) {
+	src := []byte("\x00ACME-Corp\x00host.corp.example.com\x00こんにちは世界\x00")
+	var tests = []struct {
+		rule   *Rule
+		expect string
+	}{
+		{rule: &Rule{ID: "a", Pattern: "ACME"}, expect: "\x00****-Corp\x00"},
+		{rule: &Rule{ID: "a", Pattern: "ACME", Fill: "#"}, expect: "\x00####-Corp\x00"},
+		{rule: &Rule{ID: "a", Pattern: "ACME-Corp", Replace: ReplaceNUL}, expect: "\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00"},
+		{rule: &Rule{ID: "a", Pattern: "ACME-Corp", Replace: ReplacePad, Pad: "XY"}, expect: "\x00XYXYXYXYX\x00"},
+		{rule: &Rule{ID: "a", Pattern: "[a-z]+\\.corp\\.example\\.com", Replace: ReplaceKeep, KeepFirst: 2, KeepLast: 4}, expect: "\x00ho***************.com\x00"},
+		{rule: &Rule{ID: "a", Pattern: "host", Replace: ReplaceKeep, KeepFirst: 2, KeepLast: 2}, expect: "\x00****.corp"},
+		{rule: &Rule{ID: "a", Pattern: "こんにちは世界", Replace: ReplaceKeep, KeepFirst: 1, KeepLast: 1}, expect: "\x00こ" + "***************" + "界\x00"},
+	}
+	for i, test := range tests {
+		b, err := NewBlackouterRules([]*Rule{test.rule})
+		if err != nil {
+			t.Fatalf("tests[%d]: unexpected err = %v\n", i, err)
+		}
+		dest := b.Blackout(src, nil)
+		if len(dest) != len(src) || !bytes.Contains(dest, []byte(test.expect)) {
+			t.Fatalf("tests[%d]: %q is not in %q\n", i, test.expect, dest)
+		}
+	}
+
+	pseudonym := func(id, key string) []byte {
+		b, err := NewBlackouterRules([]*Rule{{ID: id, Pattern: "ACME", Replace: ReplacePseudonym}})
+		if err != nil {
+			t.Fatalf("unexpected err = %v\n", err)
+		}
+		if key != "" {
+			b.SetKey([]byte(key))
+		}
+		return b.Blackout([]byte("ACME and ACME"), nil)
+	}
+	first := pseudonym("customer", "k1")
+	if !bytes.Equal(first, pseudonym("customer", "k1")) || first[0] == 'A' || !bytes.Equal(first[:4], first[9:]) {
+		t.Fatalf("pseudonyms should be stable = %q\n", first)
+	}
+	if bytes.Equal(first, pseudonym("other", "k1")) {
+		t.Fatalf("pseudonyms should depend on the rule id = %q\n", first)
+	}
+	if bytes.Equal(first, pseudonym("customer", "k2")) || bytes.Equal(pseudonym("customer", ""), pseudonym("customer", "")) {
+		t.Fatalf("pseudonyms should depend on the key = %q\n", first)
+	}
+
+	for _, rule := range []*Rule{
+		{ID: "a", Pattern: "a", Replace: "mask"},
+		{ID: "a", Pattern: "a", Fill: "**"},
+		{ID: "a", Pattern: "a", Replace: ReplacePad},
+		{ID: "a", Pattern: "a", Replace: ReplaceKeep, KeepFirst: -1},
+		{Pattern: "a"},
+	} {
+		if _, err := NewBlackouterRules([]*Rule{rule}); err == nil {
+			t.Fatalf("%+v: expected error\n", rule)
+		}
+	}
+}
+
+func TestHash(t *testing.T) {
+	b := NewBlackouter([]string{"ACME"})
+	b.SetKey([]byte("key"))
+	mac := hmac.New(sha256.New, []byte("key"))
+	mac.Write([]byte("ACME"))
+	if !bytes.Equal(b.Hash([]byte("ACME")), mac.Sum(nil)) {
+		t.Fatalf("Hash = %x\n", b.Hash([]byte("ACME")))
+	}
+	plain := sha256.Sum256([]byte("ACME"))
+	if bytes.Equal(NewBlackouter(nil).Hash([]byte("ACME")), plain[:]) || bytes.Equal(NewBlackouter(nil).Hash([]byte("ACME")), NewBlackouter(nil).Hash([]byte("ACME"))) {
+		t.Fatalf("Hash should depend on the random key\n")
+	}
+}
@@ -0,0 +1,187 @@
+package blackout
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/yoshitake-hamano/gocmd/config"
+)
+
+// replacement modes of a rule
+const (
+	// ReplaceFill replaces with the fill byte
+	ReplaceFill = "fill"
+	// ReplaceNUL replaces with NUL, so that strings look empty
+	ReplaceNUL = "nul"
+	// ReplacePad replaces with the pad string repeatedly
+	ReplacePad = "pad"
+	// ReplacePseudonym replaces with a token derived from the HMAC of the rule id and the match,
+	// so that the same text is replaced with the same token under the same key
+	ReplacePseudonym = "pseudonym"
+	// ReplaceKeep keeps the first and last characters, and replaces the others with the fill byte
+	ReplaceKeep = "keep"
+)
+
+var replaceModes = []string{ReplaceFill, ReplaceNUL, ReplacePad, ReplacePseudonym, ReplaceKeep}
+
+// pseudonymChars are the characters of pseudonyms
+const pseudonymChars = "abcdefghijklmnopqrstuvwxyz0123456789"
+
+// Rule is a regexp with the replacement mode.
+//
+//   rules:
+//     - id: customer
+//       pattern: "(?i)acme"
+//       replace: pseudonym
+//     - id: hostname
+//       pattern: "[a-z]+\\.corp\\.example\\.com"
+//       replace: keep
+//       keep_first: 2
+//       keep_last: 4
+//
+// Replacements always have the same length as the match.
+type Rule struct {
+	ID      string `yaml:"id" json:"id"`
+	Pattern string `yaml:"pattern" json:"pattern"`
+	// Replace is the replacement mode, "fill" if empty
+	Replace string `yaml:"replace" json:"replace"`
+	// Fill is the fill byte of "fill" and "keep", Fill if empty
+	Fill string `yaml:"fill" json:"fill"`
+	Pad  string `yaml:"pad" json:"pad"`
+	// KeepFirst and KeepLast are the number of characters kept by "keep".
+	// Matches which are not longer than them are replaced entirely.
+	KeepFirst int `yaml:"keep_first" json:"keep_first"`
+	KeepLast  int `yaml:"keep_last" json:"keep_last"`
+
+	pattern *regexp.Regexp
+	fill    byte
+}
+
+type ruleFile struct {
+	Rules []*Rule `yaml:"rules" json:"rules"`
+}
+
+// newFillRule returns the rule of a plain regexp, whose id is the regexp
+func newFillRule(r *regexp.Regexp) *Rule {
+	return &Rule{ID: r.String(), Pattern: r.String(), Replace: ReplaceFill, pattern: r, fill: Fill}
+}
+
+func containsString(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+func (rule *Rule) compile() error {
+	if rule.ID == "" || rule.Pattern == "" {
+		return fmt.Errorf("id and pattern are required")
+	}
+	if rule.Replace == "" {
+		rule.Replace = ReplaceFill
+	}
+	if !containsString(replaceModes, rule.Replace) {
+		return fmt.Errorf("replace: unknown %q(%s)", rule.Replace, strings.Join(replaceModes, ", "))
+	}
+	rule.fill = Fill
+	if rule.Fill != "" {
+		if len(rule.Fill) != 1 {
+			return fmt.Errorf("fill: %q is not one byte", rule.Fill)
+		}
+		rule.fill = rule.Fill[0]
+	}
+	if rule.Replace == ReplacePad && rule.Pad == "" {
+		return fmt.Errorf("pad: required by %s", ReplacePad)
+	}
+	if rule.KeepFirst < 0 || rule.KeepLast < 0 {
+		return fmt.Errorf("keep_first and keep_last must not be negative")
+	}
+	var err error
+	rule.pattern, err = regexp.Compile(rule.Pattern)
+	if err != nil {
+		return fmt.Errorf("pattern: %w", err)
+	}
+	return nil
+}
+
+// pseudonym returns the token of n characters for match with the HMAC key
+func (rule *Rule) pseudonym(match []byte, n int, key []byte) []byte {
+	dest := make([]byte, 0, n)
+	mac := hmac.New(sha256.New, key)
+	mac.Write(append([]byte(rule.ID+"\x00"), match...))
+	sum := mac.Sum(nil)
+	for len(dest) < n {
+		for _, b := range sum {
+			if len(dest) == n {
+				break
+			}
+			dest = append(dest, pseudonymChars[int(b)%len(pseudonymChars)])
+		}
+		mac.Reset()
+		mac.Write(sum)
+		sum = mac.Sum(nil)
+	}
+	return dest
+}
+
+// keep returns match whose characters but the first and last ones are replaced
+func (rule *Rule) keep(match []byte) []byte {
+	dest := bytes.Repeat([]byte{rule.fill}, len(match))
+	if !utf8.Valid(match) || utf8.RuneCount(match) <= rule.KeepFirst+rule.KeepLast {
+		return dest
+	}
+	first := 0
+	for i := 0; i < rule.KeepFirst; i++ {
+		_, size := utf8.DecodeRune(match[first:])
+		first += size
+	}
+	last := len(match)
+	for i := 0; i < rule.KeepLast; i++ {
+		_, size := utf8.DecodeLastRune(match[:last])
+		last -= size
+	}
+	copy(dest, match[:first])
+	copy(dest[last:], match[last:])
+	return dest
+}
+
+// replace returns the replacement of match which has the same length
+func (rule *Rule) replace(match []byte, key []byte) []byte {
+	switch rule.Replace {
+	case ReplaceNUL:
+		return make([]byte, len(match))
+	case ReplacePad:
+		return []byte(strings.Repeat(rule.Pad, len(match)/len(rule.Pad)+1)[:len(match)])
+	case ReplacePseudonym:
+		return rule.pseudonym(match, len(match), key)
+	case ReplaceKeep:
+		return rule.keep(match)
+	}
+	return bytes.Repeat([]byte{rule.fill}, len(match))
+}
+
+// ReadRules reads JSON if the extension is .json, otherwise YAML
+func ReadRules(filename string) ([]*Rule, error) {
+	rf := ruleFile{}
+	if err := config.Read(filename, &rf); err != nil {
+		return nil, fmt.Errorf("read rules: %w", err)
+	}
+	ids := make(map[string]bool)
+	for i, rule := range rf.Rules {
+		if err := rule.compile(); err != nil {
+			return nil, fmt.Errorf("read rules: %s: rules[%d]: %w", filename, i, err)
+		}
+		if ids[rule.ID] {
+			return nil, fmt.Errorf("read rules: %s: rules[%d]: duplicated id %q", filename, i, rule.ID)
+		}
+		ids[rule.ID] = true
+	}
+	return rf.Rules, nil
+}
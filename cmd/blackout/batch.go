@@ -0,0 +1,369 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+	"github.com/yoshitake-hamano/gocmd/scan"
+)
+
+// batchJob is a regular file to process
+type batchJob struct {
+	path    string
+	outPath string
+	info    os.FileInfo
+}
+
+// batch mirrors an input directory into an output directory.
+// ELF files and ELF members of tar, zip and gzip, xz or zstd compressed tar archives are blacked out,
+// and the other files are copied verbatim with their permissions.
+// Nested archives are copied verbatim.
+type batch struct {
+	r      *redactor
+	dryRun bool
+	// jobs is the number of files processed in parallel
+	jobs int
+
+	mutex    sync.Mutex
+	elfs     int
+	archives int
+	copied   int
+	symlinks int
+	errs     int
+}
+
+func (bt *batch) String() string {
+	return fmt.Sprintf("%d ELF files, %d archives, %d copied, %d symlinks, %d errors",
+		bt.elfs, bt.archives, bt.copied, bt.symlinks, bt.errs)
+}
+
+func (bt *batch) count(n *int) {
+	bt.mutex.Lock()
+	defer bt.mutex.Unlock()
+	*n++
+}
+
+func (bt *batch) error(err error) {
+	bt.mutex.Lock()
+	defer bt.mutex.Unlock()
+	bt.errs++
+	fmt.Fprintf(os.Stderr, "blackout: %v\n", err)
+}
+
+// fileMode is the permissions of a file including setuid, setgid and sticky bits
+func fileMode(info os.FileInfo) os.FileMode {
+	return info.Mode() & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+}
+
+// run mirrors in into out, and continues on errors of each file
+func (bt *batch) run(in, out string) error {
+	if out == "" && !bt.dryRun {
+		return fmt.Errorf("-o is required")
+	}
+	if out != "" {
+		absIn, err := filepath.Abs(in)
+		if err != nil {
+			return err
+		}
+		absOut, err := filepath.Abs(out)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(absIn, absOut)
+		if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return fmt.Errorf("output %s is in input %s", out, in)
+		}
+	}
+	if bt.jobs < 1 {
+		bt.jobs = 1
+	}
+
+	jobs := make(chan *batchJob)
+	wg := sync.WaitGroup{}
+	for i := 0; i < bt.jobs; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				if err := bt.processFile(j); err != nil {
+					bt.error(err)
+				}
+			}
+		}()
+	}
+
+	// directories are made writable first, and get their permissions after their files
+	dirs := make([]*batchJob, 0)
+	walkErr := filepath.Walk(in, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			bt.error(err)
+			return nil
+		}
+		rel, err := filepath.Rel(in, path)
+		if err != nil {
+			return err
+		}
+		j := &batchJob{path: path, outPath: filepath.Join(out, rel), info: info}
+		switch {
+		case info.IsDir():
+			if !bt.dryRun {
+				if err := os.MkdirAll(j.outPath, 0700); err != nil {
+					return err
+				}
+			}
+			dirs = append(dirs, j)
+		case info.Mode()&os.ModeSymlink != 0:
+			if err := bt.symlink(j); err != nil {
+				bt.error(err)
+			}
+		case info.Mode().IsRegular():
+			jobs <- j
+		default:
+			fmt.Fprintf(os.Stderr, "%s: skipped %v\n", path, info.Mode().Type())
+		}
+		return nil
+	})
+	close(jobs)
+	wg.Wait()
+	if walkErr != nil {
+		return walkErr
+	}
+
+	for i := len(dirs) - 1; i >= 0 && !bt.dryRun; i-- {
+		if err := os.Chmod(dirs[i].outPath, fileMode(dirs[i].info)); err != nil {
+			bt.error(err)
+		}
+	}
+	if bt.errs != 0 {
+		return fmt.Errorf("%d errors", bt.errs)
+	}
+	return nil
+}
+
+func (bt *batch) symlink(j *batchJob) error {
+	target, err := os.Readlink(j.path)
+	if err != nil {
+		return err
+	}
+	bt.count(&bt.symlinks)
+	if bt.dryRun {
+		return nil
+	}
+	return os.Symlink(target, j.outPath)
+}
+
+// processFile writes the file blacked out, rewritten or copied to outPath
+func (bt *batch) processFile(j *batchJob) error {
+	fp, err := os.Open(j.path)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+	magic := make([]byte, scan.MagicSize)
+	n, err := io.ReadFull(fp, magic)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	if _, err := fp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	var w io.Writer = ioutil.Discard
+	var out *os.File
+	if !bt.dryRun {
+		out, err = os.OpenFile(j.outPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+		if err != nil {
+			return err
+		}
+		defer out.Close()
+		w = out
+	}
+
+	// compressed tarballs are "tar" for scan.DetectFileType, so the compression is checked first
+	switch fileType := scan.DetectFileType(magic[:n]); {
+	case scan.DetectCompression(magic[:n]) != "":
+		err = bt.rewriteCompressed(j.path, scan.DetectCompression(magic[:n]), fp, w)
+	case fileType == scan.FileTypeELF:
+		err = bt.redactStream(j.path, fp, w)
+	case fileType == scan.FileTypeTar:
+		if err = bt.rewriteTar(j.path, fp, w); err == nil {
+			bt.count(&bt.archives)
+		}
+	case fileType == scan.FileTypeZip:
+		if err = bt.rewriteZip(j.path, w); err == nil {
+			bt.count(&bt.archives)
+		}
+	default:
+		_, err = io.Copy(w, fp)
+		bt.count(&bt.copied)
+	}
+	if err != nil {
+		if out != nil {
+			os.Remove(j.outPath)
+		}
+		return fmt.Errorf("%s: %w", j.path, err)
+	}
+	if out == nil {
+		return nil
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Chmod(j.outPath, fileMode(j.info))
+}
+
+// redactStream writes r blacked out to w if it is ELF, otherwise writes r verbatim
+func (bt *batch) redactStream(name string, r io.Reader, w io.Writer) error {
+	br := bufio.NewReaderSize(r, scan.MagicSize)
+	magic, err := br.Peek(scan.MagicSize)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	if scan.DetectFileType(magic) != scan.FileTypeELF {
+		_, err = io.Copy(w, br)
+		return err
+	}
+	data, err := ioutil.ReadAll(br)
+	if err != nil {
+		return err
+	}
+	out, err := bt.r.redact(name, data)
+	if err != nil {
+		return err
+	}
+	bt.count(&bt.elfs)
+	_, err = w.Write(out)
+	return err
+}
+
+// memberName is the name of an archive member in reports
+func memberName(archive, member string) string {
+	return archive + scan.ArchiveSeparator + member
+}
+
+// rewriteTar writes the tar archive r to w with the same headers, and ELF members blacked out
+func (bt *batch) rewriteTar(name string, r io.Reader, w io.Writer) error {
+	tr := tar.NewReader(r)
+	tw := tar.NewWriter(w)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			if _, err := io.Copy(tw, tr); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := bt.redactStream(memberName(name, hdr.Name), tr, tw); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// rewriteZip writes the zip archive to w with the same headers, and ELF members blacked out
+func (bt *batch) rewriteZip(name string, w io.Writer) error {
+	zr, err := zip.OpenReader(name)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+	zw := zip.NewWriter(w)
+	if err := zw.SetComment(zr.Comment); err != nil {
+		return err
+	}
+	for _, f := range zr.File {
+		fh := f.FileHeader
+		// the original MS-DOS time and extra fields are kept as they are
+		fh.Modified = time.Time{}
+		dest, err := zw.CreateHeader(&fh)
+		if err != nil {
+			return err
+		}
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		src, err := f.Open()
+		if err != nil {
+			return err
+		}
+		err = bt.redactStream(memberName(name, f.Name), src, dest)
+		src.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+// compressWriter returns the writer which compresses to w like zr, with the same header for gzip
+func compressWriter(compression string, zr io.Reader, w io.Writer) (io.WriteCloser, error) {
+	switch compression {
+	case scan.CompressionGzip:
+		zw := gzip.NewWriter(w)
+		if gr, ok := zr.(*gzip.Reader); ok {
+			zw.Header = gr.Header
+		}
+		return zw, nil
+	case scan.CompressionXz:
+		return xz.NewWriter(w)
+	case scan.CompressionZstd:
+		return zstd.NewWriter(w)
+	}
+	return nil, fmt.Errorf("cannot rewrite %s compressed tar archives", compression)
+}
+
+// rewriteCompressed rewrites a compressed tar archive with the same compression, and copies the other compressed files verbatim.
+// bzip2 compressed tar archives are errors, because they cannot be compressed again.
+func (bt *batch) rewriteCompressed(name, compression string, r io.ReadSeeker, w io.Writer) error {
+	zr, err := scan.DecompressReader(compression, r)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+	br := bufio.NewReaderSize(zr, scan.MagicSize)
+	magic, err := br.Peek(scan.MagicSize)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	if scan.DetectFileType(magic) != scan.FileTypeTar {
+		if _, err := r.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		_, err = io.Copy(w, r)
+		bt.count(&bt.copied)
+		return err
+	}
+	zw, err := compressWriter(compression, zr, w)
+	if err != nil {
+		return err
+	}
+	if err := bt.rewriteTar(name, br, zw); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	bt.count(&bt.archives)
+	return nil
+}
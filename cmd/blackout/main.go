@@ -2,48 +2,25 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"debug/elf"
+	"encoding/hex"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"os"
-	"regexp"
-	"strings"
-)
-
-type Blackouter struct {
-	regexps []*regexp.Regexp
-}
-
-func NewBlackouter(searchWords []string) *Blackouter {
-	regexps := make([]*regexp.Regexp, 0, len(searchWords))
-	for _, word := range searchWords {
-		r := regexp.MustCompile(word)
-		regexps = append(regexps, r)
-	}
-	return &Blackouter{
-		regexps: regexps,
-	}
-}
+	"path"
+	"runtime"
+	"sync"
 
-func (b *Blackouter) blackout(src []byte, fn func([]byte)) []byte {
-	dest := append(src[:0:0], src...)
-	for _, r := range b.regexps {
-		if fn != nil {
-			for _, match := range r.FindAll(dest, len(dest)) {
-				fn(match)
-			}
-		}
-		dest = r.ReplaceAllFunc(dest, func(repl []byte) []byte {
-			return []byte(strings.Repeat("*", len(repl)))
-		})
-	}
-	return dest
-}
+	"github.com/yoshitake-hamano/gocmd/blackout"
+)
 
 func check(err error) {
 	if err != nil {
-		panic(err)
+		fmt.Fprintf(os.Stderr, "blackout: %v\n", err)
+		os.Exit(1)
 	}
 }
 
@@ -75,51 +52,251 @@ func (s *stringsFlag) Set(value string) error {
 
 var sections stringsFlag
 
+// defaultSections is used if no -s is given
+var defaultSections = []string{".rodata"}
+
+// selectSections returns sections with contents matching glob patterns like ".rodata*" in the file order.
+// Every pattern must match at least one section unless lenient.
+func selectSections(f *elf.File, patterns []string, lenient bool) ([]*elf.Section, error) {
+	for _, p := range patterns {
+		if _, err := path.Match(p, ""); err != nil {
+			return nil, fmt.Errorf("invalid section pattern %q: %w", p, err)
+		}
+	}
+	matched := make([]bool, len(patterns))
+	selected := make([]*elf.Section, 0)
+	for _, section := range f.Sections {
+		if section.Type == elf.SHT_NULL || section.Type == elf.SHT_NOBITS {
+			continue
+		}
+		found := false
+		for i, p := range patterns {
+			if ok, _ := path.Match(p, section.Name); ok {
+				matched[i] = true
+				found = true
+			}
+		}
+		if found {
+			selected = append(selected, section)
+		}
+	}
+	for i, p := range patterns {
+		if !matched[i] && !lenient {
+			return nil, fmt.Errorf("section %s not found", p)
+		}
+	}
+	return selected, nil
+}
+
+// sectionCount is the number of matches blacked out in a section
+type sectionCount struct {
+	section string
+	count   int
+}
+
+// blackoutELF returns a copy of data whose sections matching patterns are blacked out.
+// Sections are patched in place by their offsets, so the other bytes never move.
+// fn is called with each match and its file offset if it is not nil.
+func blackoutELF(data []byte, patterns []string, lenient bool, b *blackout.Blackouter, fn func(section string, offset uint64, m blackout.Match)) ([]byte, []sectionCount, error) {
+	f, err := elf.NewFile(bytes.NewReader(data))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	selected, err := selectSections(f, patterns, lenient)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	out := append(data[:0:0], data...)
+	counts := make([]sectionCount, 0, len(selected))
+	for _, section := range selected {
+		if section.Flags&elf.SHF_COMPRESSED != 0 {
+			return nil, nil, fmt.Errorf("compressed section %s can not be blacked out", section.Name)
+		}
+		start := section.Offset
+		end := section.Offset + section.Size
+		if end < start || end > uint64(len(data)) {
+			return nil, nil, fmt.Errorf("section %s is out of the file", section.Name)
+		}
+		c := sectionCount{section: section.Name}
+		dest := b.Blackout(data[start:end], func(m blackout.Match) {
+			if fn != nil {
+				fn(section.Name, start+uint64(m.Offset), m)
+			}
+			c.count++
+		})
+		if int(section.Size) != len(dest) {
+			return nil, nil, fmt.Errorf("mismatch regexp size %s(before %d, after %d)",
+				section.Name, section.Size, len(dest))
+		}
+		copy(out[start:end], dest)
+		counts = append(counts, c)
+	}
+	if err := verifyELF(f, out); err != nil {
+		return nil, nil, err
+	}
+	return out, counts, nil
+}
+
+// verifyELF checks that out still parses as ELF with the same section headers as f
+func verifyELF(f *elf.File, out []byte) error {
+	g, err := elf.NewFile(bytes.NewReader(out))
+	if err != nil {
+		return fmt.Errorf("output is broken: %w", err)
+	}
+	defer g.Close()
+	if g.FileHeader != f.FileHeader || len(g.Sections) != len(f.Sections) {
+		return fmt.Errorf("output is broken: file header changed")
+	}
+	for i, section := range f.Sections {
+		if g.Sections[i].SectionHeader != section.SectionHeader {
+			return fmt.Errorf("output is broken: section header %s changed", section.Name)
+		}
+	}
+	return nil
+}
+
+// auditEntry records a redaction without the original text
+type auditEntry struct {
+	File    string `json:"file"`
+	Section string `json:"section"`
+	// Offset is the file offset
+	Offset uint64 `json:"offset"`
+	Length int    `json:"length"`
+	Rule   string `json:"rule"`
+	// HMAC is the HMAC-SHA256 of the original bytes with the key of the Blackouter
+	HMAC string `json:"hmac"`
+}
+
+func newAuditEntry(b *blackout.Blackouter, file, section string, offset uint64, m blackout.Match) *auditEntry {
+	return &auditEntry{
+		File:    file,
+		Section: section,
+		Offset:  offset,
+		Length:  len(m.Original),
+		Rule:    m.Rule.ID,
+		HMAC:    hex.EncodeToString(b.Hash(m.Original)),
+	}
+}
+
+// redactor blacks out ELF files and reports each redaction
+type redactor struct {
+	b        *blackout.Blackouter
+	patterns []string
+	// lenient allows patterns which match no section, for files in batch mode
+	lenient bool
+	mutex   sync.Mutex
+	// audit writes the audit log, or nil to report redactions to stderr
+	audit *json.Encoder
+}
+
+func (r *redactor) report(file, section string, offset uint64, m blackout.Match) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.audit != nil {
+		return r.audit.Encode(newAuditEntry(r.b, file, section, offset, m))
+	}
+	fmt.Fprintf(os.Stderr, "%s: %s: offset 0x%x, %d bytes by %s\n", file, section, offset, len(m.Original), m.Rule.ID)
+	return nil
+}
+
+// redact returns the copy of ELF data of file blacked out.
+// Sections without matches are not reported if lenient.
+func (r *redactor) redact(file string, data []byte) ([]byte, error) {
+	var reportErr error
+	out, counts, err := blackoutELF(data, r.patterns, r.lenient, r.b, func(section string, offset uint64, m blackout.Match) {
+		if err := r.report(file, section, offset, m); err != nil && reportErr == nil {
+			reportErr = err
+		}
+	})
+	if err == nil {
+		err = reportErr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for _, c := range counts {
+		if c.count != 0 || !r.lenient {
+			fmt.Fprintf(os.Stderr, "%s: %s: %d replaced\n", file, c.section, c.count)
+		}
+	}
+	return out, nil
+}
+
 func main() {
 	var (
-		inputfile  = flag.String("i", "", "input file")
-		outputfile = flag.String("o", "", "output file")
+		inputfile  = flag.String("i", "", "input file, or directory to black out ELF files and ELF members of tar and zip archives")
+		outputfile = flag.String("o", "", "output file, or directory mirroring the input directory")
+		jobs       = flag.Int("j", runtime.GOMAXPROCS(0), "number of files blacked out in parallel in directory mode")
 		regexpfile = flag.String("r", "", "regexp file")
+		dryRun     = flag.Bool("dry-run", false, "report redactions without writing the output file")
+		auditfile  = flag.String("audit", "", "audit log(json lines) of file, section, offset, length, rule and hmac of each redaction, - for stdout")
+		keyfile    = flag.String("key", "", "key file of hmacs in the audit log and pseudonyms, which are keyed by a random key per run if empty")
+		rulesfile  = flag.String("rules", "", "rule file(yaml or json) with id, pattern and replace(fill, nul, pad, pseudonym, keep)")
 	)
-	flag.Var(&sections, "s", "sections to black out")
+	flag.Var(&sections, "s", "sections to black out(glob like .rodata*), can be repeated(default .rodata)")
 	flag.Parse()
-	for _, s := range sections {
-		fmt.Printf("%s\n", s)
+	if len(sections) == 0 {
+		sections = defaultSections
 	}
 
-	filedata, err := ioutil.ReadFile(*inputfile)
-	check(err)
-
-	config, err := readConfig(*regexpfile)
-	check(err)
-	b := NewBlackouter(config)
-	f, err := elf.Open(*inputfile)
-	check(err)
-	defer f.Close()
-
-	for _, section := range f.Sections {
-		if section.Name != ".rodata" {
-			continue
+	rules := make([]*blackout.Rule, 0)
+	if *regexpfile != "" || *rulesfile == "" {
+		config, err := readConfig(*regexpfile)
+		check(err)
+		for _, word := range config {
+			if word != "" {
+				rules = append(rules, &blackout.Rule{ID: word, Pattern: word})
+			}
 		}
-
-		src, err := section.Data()
+	}
+	if *rulesfile != "" {
+		r, err := blackout.ReadRules(*rulesfile)
 		check(err)
-		dest := b.blackout(src, func(match []byte) {
-			fmt.Printf("%s: %s\n", *inputfile, string(match))
-		})
-		if int(section.Size) != len(dest) {
-			check(fmt.Errorf("mismatch regexp size %s(before %d, after %d)",
-				section.Name, section.Size, len(dest)))
+		rules = append(rules, r...)
+	}
+	b, err := blackout.NewBlackouterRules(rules)
+	check(err)
+	if *keyfile != "" {
+		key, err := ioutil.ReadFile(*keyfile)
+		check(err)
+		if len(key) == 0 {
+			check(fmt.Errorf("%s: empty key", *keyfile))
 		}
+		b.SetKey(key)
+	}
+	r := &redactor{b: b, patterns: sections}
+	if *auditfile == "-" {
+		r.audit = json.NewEncoder(os.Stdout)
+	} else if *auditfile != "" {
+		fp, err := os.Create(*auditfile)
+		check(err)
+		defer fp.Close()
+		r.audit = json.NewEncoder(fp)
+	}
 
-		sectionStart := section.Offset
-		sectionEnd := section.Offset + section.Size
-		tmp := append(filedata[0:sectionStart], dest...)
-		filedata = append(tmp, filedata[sectionEnd:]...)
+	info, err := os.Stat(*inputfile)
+	check(err)
+	if info.IsDir() {
+		r.lenient = true
+		bt := &batch{r: r, dryRun: *dryRun, jobs: *jobs}
+		err := bt.run(*inputfile, *outputfile)
+		fmt.Fprintf(os.Stderr, "blackout: %s\n", bt)
+		check(err)
+		return
 	}
 
-	err = ioutil.WriteFile(*outputfile, filedata, 0644)
+	filedata, err := ioutil.ReadFile(*inputfile)
 	check(err)
+	out, err := r.redact(*inputfile, filedata)
+	check(err)
+	if !*dryRun {
+		err = ioutil.WriteFile(*outputfile, out, 0644)
+		check(err)
+	}
 
 	// d, err := f.DWARF()
 	// check(err)
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"debug/elf"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/ulikunitz/xz"
+	"github.com/yoshitake-hamano/gocmd/blackout"
+)
+
+// markers are kept in the test binary, the string in .rodata and the array in .noptrdata
+const rodataMarker = "\x00XyzzyRodataMarker\x00"
+
+var dataMarker = [...]byte{0, 'X', 'y', 'z', 'z', 'y', 'D', 'a', 't', 'a', 'M', 'a', 'r', 'k', 'e', 'r', 0}
+
+func readTestBinary(t *testing.T) []byte {
+	if runtime.GOOS != "linux" {
+		t.Skip("the test binary is not ELF")
+	}
+	data, err := ioutil.ReadFile(os.Args[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestBlackoutELF(t *testing.T) {
+	data := readTestBinary(t)
+	if !bytes.Contains(dataMarker[:], []byte(rodataMarker[1:6])) {
+		t.Fatalf("markers are optimized out\n")
+	}
+
+	b := blackout.NewBlackouter([]string{"Xyzzy[A-Za-z]+Marker"})
+	out, counts, err := blackoutELF(data, []string{".rodata", ".noptr*"}, false, b, nil)
+	if err != nil {
+		t.Fatalf("unexpected err = %v\n", err)
+	}
+	found := make(map[string]int)
+	for _, c := range counts {
+		found[c.section] = c.count
+	}
+	if found[".rodata"] == 0 || found[".noptrdata"] == 0 {
+		t.Fatalf("markers are not blacked out = %v\n", counts)
+	}
+
+	f, err := elf.NewFile(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	target := func(offset int) bool {
+		for _, name := range []string{".rodata", ".noptrdata"} {
+			s := f.Section(name)
+			if s != nil && s.Type != elf.SHT_NOBITS && s.Offset <= uint64(offset) && uint64(offset) < s.Offset+s.Size {
+				return true
+			}
+		}
+		return false
+	}
+	if len(out) != len(data) {
+		t.Fatalf("size changed(before %d, after %d)\n", len(data), len(out))
+	}
+	for i := range data {
+		if out[i] != data[i] && (!target(i) || out[i] != blackout.Fill) {
+			t.Fatalf("unexpected change at 0x%x: 0x%02x -> 0x%02x\n", i, data[i], out[i])
+		}
+	}
+	if bytes.Contains(out, []byte("XyzzyRodataMarker")) || bytes.Contains(out, []byte("XyzzyDataMarker")) {
+		t.Fatalf("markers remain\n")
+	}
+}
+
+func TestBlackoutELFErrors(t *testing.T) {
+	data := readTestBinary(t)
+	b := blackout.NewBlackouter([]string{"Xyzzy[A-Za-z]+Marker"})
+	for _, patterns := range [][]string{{".nothing"}, {".rodata", ".nothing*"}, {"[.rodata"}, {".bss"}} {
+		if _, _, err := blackoutELF(data, patterns, false, b, nil); err == nil {
+			t.Fatalf("%v: expected error\n", patterns)
+		}
+	}
+	if _, _, err := blackoutELF(data, []string{".shstrtab"}, false, blackout.NewBlackouter([]string{"rodata"}), nil); err == nil {
+		t.Fatalf("expected broken section headers\n")
+	}
+}
+
+func TestAudit(t *testing.T) {
+	data := readTestBinary(t)
+	b := blackout.NewBlackouter([]string{"XyzzyRodataMarker"})
+	entries := make([]*auditEntry, 0)
+	_, counts, err := blackoutELF(data, []string{".rodata"}, false, b, func(section string, offset uint64, m blackout.Match) {
+		entries = append(entries, newAuditEntry(b, "a", section, offset, m))
+	})
+	if err != nil {
+		t.Fatalf("unexpected err = %v\n", err)
+	}
+	if len(entries) == 0 || len(entries) != counts[0].count {
+		t.Fatalf("unexpected entries = %v, counts = %v\n", entries, counts)
+	}
+	sum := sha256.Sum256([]byte("XyzzyRodataMarker"))
+	for _, e := range entries {
+		original := string(data[e.Offset : e.Offset+uint64(e.Length)])
+		if e.HMAC == hex.EncodeToString(sum[:]) {
+			t.Fatalf("hmac should not be the plain hash = %+v\n", e)
+		}
+		if original != "XyzzyRodataMarker" || e.HMAC != hex.EncodeToString(b.Hash([]byte(original))) || e.Rule != "XyzzyRodataMarker" || e.Section != ".rodata" {
+			t.Fatalf("unexpected entry = %+v(%q)\n", e, original)
+		}
+	}
+}
+
+func TestBatch(t *testing.T) {
+	data := readTestBinary(t)
+	in, err := ioutil.TempDir("", "blackout-in")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(in)
+	out, err := ioutil.TempDir("", "blackout-out")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(out)
+
+	tarData := func() []byte {
+		buf := &bytes.Buffer{}
+		tw := tar.NewWriter(buf)
+		tw.WriteHeader(&tar.Header{Name: "bin/", Typeflag: tar.TypeDir, Mode: 0755})
+		tw.WriteHeader(&tar.Header{Name: "bin/app", Typeflag: tar.TypeReg, Mode: 0755, Size: int64(len(data))})
+		tw.Write(data)
+		tw.WriteHeader(&tar.Header{Name: "bin/link", Typeflag: tar.TypeSymlink, Linkname: "app"})
+		tw.Close()
+		return buf.Bytes()
+	}()
+	zipBuf := &bytes.Buffer{}
+	zw := zip.NewWriter(zipBuf)
+	w, _ := zw.Create("bin/app")
+	w.Write(data)
+	w, _ = zw.Create("README")
+	w.Write([]byte(rodataMarker))
+	zw.Close()
+	gzBuf := &bytes.Buffer{}
+	gw := gzip.NewWriter(gzBuf)
+	gw.Name = "app.tar"
+	gw.Write(tarData)
+	gw.Close()
+	xzBuf := &bytes.Buffer{}
+	xw, err := xz.NewWriter(xzBuf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	xw.Write(tarData)
+	xw.Close()
+
+	files := map[string][]byte{
+		"bin/app":         data,
+		"doc/README":      []byte(rodataMarker),
+		"dist/app.tar":    tarData,
+		"dist/app.zip":    zipBuf.Bytes(),
+		"dist/app.tar.gz": gzBuf.Bytes(),
+		"dist/app.tar.xz": xzBuf.Bytes(),
+	}
+	for name, content := range files {
+		path := filepath.Join(in, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, content, 0640); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Chmod(filepath.Join(in, "bin/app"), 0751); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("app", filepath.Join(in, "bin/link")); err != nil {
+		t.Fatal(err)
+	}
+
+	r := &redactor{b: blackout.NewBlackouter([]string{"Xyzzy[A-Za-z]+Marker"}), patterns: []string{".rodata"}, lenient: true}
+	bt := &batch{r: r, jobs: 2}
+	if err := bt.run(in, filepath.Join(in, "out")); err == nil {
+		t.Fatalf("expected output in input\n")
+	}
+	if err := bt.run(in, out); err != nil {
+		t.Fatalf("unexpected err = %v\n", err)
+	}
+	if bt.elfs != 5 || bt.archives != 4 || bt.copied != 1 || bt.symlinks != 1 || bt.errs != 0 {
+		t.Fatalf("unexpected stats = %s\n", bt)
+	}
+
+	redacted := func(name string, content []byte) {
+		if len(content) != len(data) || bytes.Contains(content, []byte("XyzzyRodataMarker")) {
+			t.Fatalf("%s is not blacked out\n", name)
+		}
+	}
+	read := func(name string) []byte {
+		content, err := ioutil.ReadFile(filepath.Join(out, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return content
+	}
+	redacted("bin/app", read("bin/app"))
+	if info, err := os.Stat(filepath.Join(out, "bin/app")); err != nil || info.Mode().Perm() != 0751 {
+		t.Fatalf("unexpected mode = %v, %v\n", info, err)
+	}
+	if target, err := os.Readlink(filepath.Join(out, "bin/link")); err != nil || target != "app" {
+		t.Fatalf("unexpected symlink = %s, %v\n", target, err)
+	}
+	if !bytes.Equal(read("doc/README"), []byte(rodataMarker)) {
+		t.Fatalf("README is not copied verbatim\n")
+	}
+
+	checkTar := func(name string, r io.Reader) {
+		tr := tar.NewReader(r)
+		n := 0
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("%s: unexpected err = %v\n", name, err)
+			}
+			n++
+			if hdr.Name == "bin/app" {
+				content, _ := ioutil.ReadAll(tr)
+				redacted(name, content)
+			}
+		}
+		if n != 3 {
+			t.Fatalf("%s: unexpected members = %d\n", name, n)
+		}
+	}
+	checkTar("dist/app.tar", bytes.NewReader(read("dist/app.tar")))
+	gr, err := gzip.NewReader(bytes.NewReader(read("dist/app.tar.gz")))
+	if err != nil || gr.Name != "app.tar" {
+		t.Fatalf("unexpected gzip header = %v\n", err)
+	}
+	checkTar("dist/app.tar.gz", gr)
+	xr, err := xz.NewReader(bytes.NewReader(read("dist/app.tar.xz")))
+	if err != nil {
+		t.Fatalf("unexpected xz = %v\n", err)
+	}
+	checkTar("dist/app.tar.xz", xr)
+
+	zipData := read("dist/app.zip")
+	zr, err := zip.NewReader(bytes.NewReader(zipData), int64(len(zipData)))
+	if err != nil || len(zr.File) != 2 {
+		t.Fatalf("unexpected zip = %v\n", err)
+	}
+	for _, f := range zr.File {
+		fr, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := ioutil.ReadAll(fr)
+		fr.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f.Name == "bin/app" {
+			redacted("dist/app.zip!bin/app", content)
+		} else if string(content) != rodataMarker {
+			t.Fatalf("%s is not copied verbatim\n", f.Name)
+		}
+	}
+}
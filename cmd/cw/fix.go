@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"debug/elf"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/yoshitake-hamano/gocmd/blackout"
+	"github.com/yoshitake-hamano/gocmd/scan"
+)
+
+// fixable reports whether the result can be masked in place.
+// Only plain ELF files are fixed, because archive members and compressed sections
+// can not be patched without rebuilding them.
+func fixable(r *scan.Result) bool {
+	return r.FileType == "elf" && r.Section != "" && r.Compression == "" &&
+		!strings.Contains(r.Path, scan.ArchiveSeparator) &&
+		(r.Encoding == scan.EncodingASCII || r.Encoding == scan.EncodingUTF8)
+}
+
+type fixSummary struct {
+	files   int
+	fixed   int
+	skipped int
+	// remains are the results found again in the fixed files
+	remains []*scan.Result
+}
+
+func (fs *fixSummary) String() string {
+	return fmt.Sprintf("%d hits fixed in %d files, %d skipped, %d remain", fs.fixed, fs.files, fs.skipped, len(fs.remains))
+}
+
+// fixPath returns the path under outDir of path found in inputPath.
+// It keeps the path relative to inputPath, and rejects paths escaping outDir.
+func fixPath(inputPath, path, outDir string) (string, error) {
+	rel := path
+	if inputPath != "" {
+		var err error
+		rel, err = filepath.Rel(inputPath, path)
+		if err != nil {
+			return "", err
+		}
+		if rel == "." {
+			// inputPath is the file itself
+			rel = filepath.Base(path)
+		}
+	}
+	rel = filepath.Clean(rel)
+	if filepath.IsAbs(rel) || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%s escapes %s", path, outDir)
+	}
+	return filepath.Join(outDir, rel), nil
+}
+
+// fixFiles masks results by blackout, writes the fixed files under outDir
+// with the paths relative to inputPath, and scans them again as the original paths.
+func fixFiles(b *scan.Finder, results []*scan.Result, inputPath, outDir string) (*fixSummary, error) {
+	summary := &fixSummary{}
+	paths := make([]string, 0)
+	byPath := make(map[string][]*scan.Result)
+	for _, r := range results {
+		if !fixable(r) {
+			summary.skipped++
+			continue
+		}
+		if _, ok := byPath[r.Path]; !ok {
+			paths = append(paths, r.Path)
+		}
+		byPath[r.Path] = append(byPath[r.Path], r)
+	}
+
+	blackouters := make(map[string]*blackout.Blackouter)
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		f, err := elf.NewFile(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+
+		fixed := append(data[:0:0], data...)
+		for _, r := range byPath[path] {
+			section := f.Section(r.Section)
+			if section == nil {
+				return nil, fmt.Errorf("%s: section %s not found", path, r.Section)
+			}
+			start := section.Offset + uint64(r.SectionOffset)
+			end := start + uint64(r.ByteLength())
+			if end > section.Offset+section.Size || end > uint64(len(fixed)) {
+				return nil, fmt.Errorf("%s: %s+0x%x is out of the section", path, r.Section, r.SectionOffset)
+			}
+			bo, ok := blackouters[r.Keyword]
+			if !ok {
+				bo = blackout.NewBlackouterRegexps([]*regexp.Regexp{regexp.MustCompile(r.Keyword)})
+				blackouters[r.Keyword] = bo
+			}
+			dest := bo.Blackout(fixed[start:end], nil)
+			if len(dest) != int(end-start) {
+				return nil, fmt.Errorf("%s: mismatch size %s+0x%x(before %d, after %d)", path, r.Section, r.SectionOffset, end-start, len(dest))
+			}
+			copy(fixed[start:end], dest)
+			summary.fixed++
+		}
+		f.Close()
+
+		outPath, err := fixPath(inputPath, path, outDir)
+		if err != nil {
+			return nil, err
+		}
+		if err := os.MkdirAll(filepath.Dir(outPath), 0755); err != nil {
+			return nil, err
+		}
+		if err := ioutil.WriteFile(outPath, fixed, info.Mode().Perm()); err != nil {
+			return nil, err
+		}
+		summary.files++
+
+		collector := &scan.ResultCollector{}
+		// rules with paths match the original path, not outPath
+		if err := b.RescanData(path, fixed, collector); err != nil {
+			return nil, err
+		}
+		for _, again := range collector.Results {
+			for _, r := range byPath[path] {
+				if again.Section == r.Section && again.SectionOffset == r.SectionOffset && again.Keyword == r.Keyword {
+					summary.remains = append(summary.remains, again)
+					break
+				}
+			}
+		}
+	}
+	return summary, nil
+}
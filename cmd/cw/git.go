@@ -0,0 +1,351 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+
+	"github.com/yoshitake-hamano/gocmd/scan"
+)
+
+// gitRange is the commits reachable from to but not from from, like "git log from..to".
+// If from is nil, all files in to are scanned.
+type gitRange struct {
+	repo *git.Repository
+	from *object.Commit
+	to   *object.Commit
+	// commits are sorted topologically, parents first
+	commits []*object.Commit
+}
+
+// gitVersion is a blob of a path written by a commit.
+// commit is nil for the blob in the base revision.
+type gitVersion struct {
+	commit *object.Commit
+	blob   plumbing.Hash
+}
+
+func resolveCommit(repo *git.Repository, rev string) (*object.Commit, error) {
+	hash, err := repo.ResolveRevision(plumbing.Revision(rev))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", rev, err)
+	}
+	return repo.CommitObject(*hash)
+}
+
+func openGitRange(path, from, to string) (*gitRange, error) {
+	repo, err := git.PlainOpenWithOptions(path, &git.PlainOpenOptions{DetectDotGit: true})
+	if err != nil {
+		return nil, fmt.Errorf("git: %s: %w", path, err)
+	}
+	gr := &gitRange{repo: repo}
+	gr.to, err = resolveCommit(repo, to)
+	if err != nil {
+		return nil, fmt.Errorf("git: %w", err)
+	}
+
+	seen := make(map[plumbing.Hash]bool)
+	if from != "" {
+		gr.from, err = resolveCommit(repo, from)
+		if err != nil {
+			return nil, fmt.Errorf("git: %w", err)
+		}
+		err = object.NewCommitPreorderIter(gr.from, nil, nil).ForEach(func(c *object.Commit) error {
+			seen[c.Hash] = true
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("git: %w", err)
+		}
+	}
+
+	inRange := make(map[plumbing.Hash]*object.Commit)
+	err = object.NewCommitPreorderIter(gr.to, seen, nil).ForEach(func(c *object.Commit) error {
+		inRange[c.Hash] = c
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("git: %w", err)
+	}
+
+	// postorder depth first search puts parents before children
+	visited := make(map[plumbing.Hash]bool)
+	var visit func(c *object.Commit)
+	visit = func(c *object.Commit) {
+		if visited[c.Hash] {
+			return
+		}
+		visited[c.Hash] = true
+		for _, h := range c.ParentHashes {
+			if p, ok := inRange[h]; ok {
+				visit(p)
+			}
+		}
+		gr.commits = append(gr.commits, c)
+	}
+	visit(gr.to)
+	return gr, nil
+}
+
+func treeOf(c *object.Commit) (*object.Tree, error) {
+	if c == nil {
+		return nil, nil
+	}
+	return c.Tree()
+}
+
+// addedFiles returns the regular files added or modified from a to b
+func addedFiles(a, b *object.Tree) ([]*object.ChangeEntry, error) {
+	changes, err := object.DiffTree(a, b)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]*object.ChangeEntry, 0, len(changes))
+	for _, change := range changes {
+		to := change.To
+		if to.Name == "" {
+			continue
+		}
+		if to.TreeEntry.Mode != filemode.Regular && to.TreeEntry.Mode != filemode.Executable {
+			continue
+		}
+		entries = append(entries, &to)
+	}
+	return entries, nil
+}
+
+// versions returns blobs written by each commit in the range per path.
+// A merge commit is compared with its first parent.
+func (gr *gitRange) versions() (map[string][]gitVersion, error) {
+	versions := make(map[string][]gitVersion)
+	for _, c := range gr.commits {
+		var parent *object.Commit
+		if c.NumParents() != 0 {
+			var err error
+			parent, err = c.Parent(0)
+			if err != nil {
+				return nil, err
+			}
+		}
+		a, err := treeOf(parent)
+		if err != nil {
+			return nil, err
+		}
+		b, err := c.Tree()
+		if err != nil {
+			return nil, err
+		}
+		entries, err := addedFiles(a, b)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			versions[e.Name] = append(versions[e.Name], gitVersion{commit: c, blob: e.TreeEntry.Hash})
+		}
+	}
+	return versions, nil
+}
+
+func (gr *gitRange) readBlob(hash plumbing.Hash) ([]byte, error) {
+	blob, err := gr.repo.BlobObject(hash)
+	if err != nil {
+		return nil, err
+	}
+	r, err := blob.Reader()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+// selectBlob returns whether w selects the blob like a file in a directory
+func (gr *gitRange) selectBlob(w *walker, hash plumbing.Hash) (bool, error) {
+	blob, err := gr.repo.BlobObject(hash)
+	if err != nil {
+		return false, err
+	}
+	return w.selectContent(blob.Size, func() ([]byte, error) {
+		r, err := blob.Reader()
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return readMagic(r)
+	})
+}
+
+// gitIgnores reads .cwignore files from a tree like the walker reads them from directories
+type gitIgnores struct {
+	tree *object.Tree
+	// files are .cwignore files per directory, nil if not exists
+	files map[string]*cwignore
+}
+
+func (gi *gitIgnores) read(dir string) (*cwignore, error) {
+	if c, ok := gi.files[dir]; ok {
+		return c, nil
+	}
+	name := cwignoreName
+	if dir != "" {
+		name = dir + "/" + cwignoreName
+	}
+	var c *cwignore
+	f, err := gi.tree.File(name)
+	switch {
+	case err == object.ErrFileNotFound:
+	case err != nil:
+		return nil, err
+	default:
+		contents, err := f.Contents()
+		if err != nil {
+			return nil, err
+		}
+		c, err = parseCwignore(dir, []byte(contents))
+		if err != nil {
+			return nil, fmt.Errorf("%s:%w", name, err)
+		}
+	}
+	gi.files[dir] = c
+	return c, nil
+}
+
+// ignored returns whether w ignores name or one of its directories
+// by -ignore or .cwignore files in the tree
+func (gi *gitIgnores) ignored(w *walker, name string) (bool, error) {
+	ignores := make([]*cwignore, 0)
+	dirs := strings.Split(name, "/")
+	for i := 0; i < len(dirs); i++ {
+		dir := strings.Join(dirs[:i], "/")
+		if dir != "" && w.ignored(dir, true, ignores) {
+			return true, nil
+		}
+		c, err := gi.read(dir)
+		if err != nil {
+			return false, err
+		}
+		if c != nil {
+			ignores = append(ignores, c)
+		}
+	}
+	return w.ignored(name, false, ignores), nil
+}
+
+func gitAuthor(c *object.Commit) string {
+	return fmt.Sprintf("%s <%s>", c.Author.Name, c.Author.Email)
+}
+
+// findGitFile scans the blob of path, and attributes each result to the
+// oldest commit in the range whose version of path already has it.
+// Results which exist in the base revision are not attributed.
+func findGitFile(b *scan.Finder, gr *gitRange, path string, blob plumbing.Hash, versions []gitVersion, rw scan.ResultWriter) error {
+	// only the blob of the target revision is counted as a file
+	scanBlob := func(hash plumbing.Hash, find func(string, []byte, scan.ResultWriter) error) ([]*scan.Result, error) {
+		data, err := gr.readBlob(hash)
+		if err != nil {
+			return nil, err
+		}
+		collector := &scan.ResultCollector{}
+		if err := find(path, data, collector); err != nil {
+			return nil, err
+		}
+		return collector.Results, nil
+	}
+
+	results, err := scanBlob(blob, b.FindData)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	unattributed := make(map[string][]*scan.Result)
+	for _, r := range results {
+		unattributed[r.CSVKey()] = append(unattributed[r.CSVKey()], r)
+	}
+	for _, v := range versions {
+		if len(unattributed) == 0 {
+			break
+		}
+		found := results
+		if v.blob != blob {
+			found, err = scanBlob(v.blob, b.RescanData)
+			if err != nil {
+				return fmt.Errorf("%s@%s: %w", path, v.blob, err)
+			}
+		}
+		for _, r := range found {
+			key := r.CSVKey()
+			for _, u := range unattributed[key] {
+				if v.commit != nil {
+					u.Commit = v.commit.Hash.String()
+					u.Author = gitAuthor(v.commit)
+				}
+			}
+			delete(unattributed, key)
+		}
+	}
+
+	for _, r := range results {
+		rw.Write(r)
+	}
+	return nil
+}
+
+// mainImplGit scans files added or modified between two revisions
+// straight from the object database.
+// Files are selected by w with .cwignore files in the target revision.
+func mainImplGit(b *scan.Finder, repoPath, from, to string, w *walker, rw scan.ResultWriter) error {
+	gr, err := openGitRange(repoPath, from, to)
+	if err != nil {
+		return err
+	}
+	a, err := treeOf(gr.from)
+	if err != nil {
+		return fmt.Errorf("git: %w", err)
+	}
+	t, err := gr.to.Tree()
+	if err != nil {
+		return fmt.Errorf("git: %w", err)
+	}
+	entries, err := addedFiles(a, t)
+	if err != nil {
+		return fmt.Errorf("git: %w", err)
+	}
+	versions, err := gr.versions()
+	if err != nil {
+		return fmt.Errorf("git: %w", err)
+	}
+
+	errs := &findErrorCollector{}
+	gi := &gitIgnores{tree: t, files: make(map[string]*cwignore)}
+	for _, e := range entries {
+		ignored, err := gi.ignored(w, e.Name)
+		if err != nil {
+			errs.add(fmt.Errorf("%s: %w", e.Name, err))
+			continue
+		}
+		if ignored {
+			continue
+		}
+		selected, err := gr.selectBlob(w, e.TreeEntry.Hash)
+		if err != nil {
+			errs.add(fmt.Errorf("%s: %w", e.Name, err))
+			continue
+		}
+		if !selected {
+			continue
+		}
+		vs := versions[e.Name]
+		if a != nil {
+			if base, err := a.FindEntry(e.Name); err == nil {
+				vs = append([]gitVersion{{blob: base.Hash}}, vs...)
+			}
+		}
+		errs.add(findGitFile(b, gr, e.Name, e.TreeEntry.Hash, vs, rw))
+	}
+	errs.add(rw.Flush())
+	return errs.err()
+}
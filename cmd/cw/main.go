@@ -2,194 +2,83 @@ package main
 
 import (
 	"bufio"
-	"bytes"
-	"debug/elf"
 	"flag"
 	"fmt"
-	"io"
 	"os"
 	"path/filepath"
 	"regexp"
+	"runtime"
+	"sort"
+	"strings"
 	"sync"
-)
-
-type Finder struct {
-	blacklist []*regexp.Regexp
-	whitelist []*regexp.Regexp
-}
-
-type ResultWriter interface {
-	Write(path, filetype, section, keyword, text string)
-}
-
-type ResultWriterImpl struct {
-	w io.Writer
-}
-
-type DummyResultWriter struct {
-}
-
-func compileRegexps(regexps []string) []*regexp.Regexp {
-	compiled := make([]*regexp.Regexp, 0, len(regexps))
-	for _, reg := range regexps {
-		r := regexp.MustCompile(reg)
-		compiled = append(compiled, r)
-	}
-	return compiled
-}
-
-func matchRegexps(str string, regexps []*regexp.Regexp) (bool, *regexp.Regexp) {
-	for _, reg := range regexps {
-		if reg.MatchString(str) {
-			return true, reg
-		}
-	}
-	return false, nil
-}
+	"time"
 
-func matchAllRegexps(str string, regexps []*regexp.Regexp) []*regexp.Regexp {
-	r := make([]*regexp.Regexp, 0)
-	for _, reg := range regexps {
-		if reg.MatchString(str) {
-			r = append(r, reg)
-		}
-	}
-	return r
-}
+	"github.com/yoshitake-hamano/gocmd/scan"
+)
 
-func NewFinder(blacklist, whitelist []*regexp.Regexp) *Finder {
-	return &Finder{
-		blacklist: blacklist,
-		whitelist: whitelist,
-	}
-}
+const (
+	exitClean = 0
+	exitFound = 1
+	exitError = 2
+)
 
-func isTokenable(b byte) bool {
-	// see ascii table
-	if 0x20 <= b && b <= 0x7e {
-		return true
-	}
-	return b == '\t'
-}
+// FindErrors is the list of errors of files which could not be scanned
+type FindErrors []error
 
-func split(data []byte, atEOF bool) (advance int, token []byte, err error) {
-	if len(data) == 0 {
-		return 0, nil, nil
+func (fe FindErrors) Error() string {
+	if len(fe) == 1 {
+		return fe[0].Error()
 	}
-	startOfToken := len(data)
-	for i:=0; i<len(data); i++ {
-		if isTokenable(data[i]) {
-			startOfToken = i
-			break
-		}
-	}
-	for i:=startOfToken; i<len(data); i++ {
-		if ! isTokenable(data[i]) {
-			return i+1, data[startOfToken:i], nil
-		}
-	}
-	return len(data), data[startOfToken:], nil
+	return fmt.Sprintf("%d errors occurred: %v", len(fe), []error(fe))
 }
 
-func (b *Finder) findBinary(path, filetype, section string, r io.Reader, rw ResultWriter) error {
-	scanner := bufio.NewScanner(r)
-	scanner.Split(split)
-	for scanner.Scan() {
-		t := scanner.Text()
-		if t == "" {
-			continue
-		}
-		if match, _ := matchRegexps(t, b.whitelist); match {
-			continue
-		}
-		for _, keyword := range matchAllRegexps(t, b.blacklist) {
-			rw.Write(path, filetype, section, keyword.String(), t)
-		}
-	}
-	return nil
+type findErrorCollector struct {
+	mutex  sync.Mutex
+	errors FindErrors
 }
 
-func (b *Finder) findElf(path string, r io.Reader, rw ResultWriter) error {
-	f, err := elf.Open(path)
-	if err != nil {
-		return err
+func (c *findErrorCollector) add(err error) {
+	if err == nil {
+		return
 	}
-	defer f.Close()
-
-	for _, section := range f.Sections {
-		// @see binutils strings.c
-		// #define DATA_FLAGS (SEC_ALLOC | SEC_LOAD | SEC_HAS_CONTENTS)
-		if (section.Flags & elf.SHF_ALLOC) != 0 {
-			continue
-		}
-		if section.Type == elf.SHT_NOBITS {
-			continue
-		}
-		
-		src, err := section.Data()
-		if err != nil {
-			return err
-		}
-		err = b.findBinary(path, "elf", section.Name, bytes.NewReader(src), rw)
-		if err != nil {
-			return err
-		}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if fe, ok := err.(FindErrors); ok {
+		c.errors = append(c.errors, fe...)
+		return
 	}
-	return nil
+	c.errors = append(c.errors, err)
 }
 
-func (b *Finder) Find(path string, rw ResultWriter) error {
-	r, err := os.Open(path)
-	defer r.Close()
-	if err != nil {
-		return err
-	}
-
-	r1 := bytes.NewBuffer(nil)
-	r2 := io.TeeReader(r, r1)
-	if b.findElf(path, r1, rw) == nil {
+func (c *findErrorCollector) err() error {
+	if len(c.errors) == 0 {
 		return nil
 	}
-	return b.findBinary(path, "bin", "", r2, rw)
-}
-
-func NewResultWriter(w io.Writer) ResultWriter {
-	if w == nil {
-		return &DummyResultWriter{}
-	}
-	return &ResultWriterImpl{
-		w: w,
-	}
-}
-
-func (rw *ResultWriterImpl) Write(path, filetype, section, keyword, text string) {
-	r := regexp.MustCompile("[\t,\"]")
-	t := r.ReplaceAllString(text, "")
-	fmt.Fprintf(rw.w, "%s,%s,%s,%s,%s\n", path, filetype, section, keyword, t)
-}
-
-func (dw *DummyResultWriter) Write(path, filetype, section, keyword, text string) {
-}
-
-func check(format string, err error) {
-	if err != nil {
-		panic(fmt.Errorf(format, err))
-	}
+	return c.errors
 }
 
+// readRegexps reads one regexp per line. Blank lines and lines starting with "#" are skipped.
 func readRegexps(filename string) ([]*regexp.Regexp, error) {
-	regexps := make([]string, 0)
 	fp, err := os.Open(filename)
-	defer fp.Close()
 	if err != nil {
 		return nil, fmt.Errorf("read regexps: %w", err)
 	}
+	defer fp.Close()
 
+	regexps := make([]*regexp.Regexp, 0)
 	scanner := bufio.NewScanner(fp)
-	for scanner.Scan() {
-		regexps = append(regexps, scanner.Text())
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		if strings.TrimSpace(text) == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		r, err := regexp.Compile(text)
+		if err != nil {
+			return nil, fmt.Errorf("read regexps: %s:%d: %w", filename, line, err)
+		}
+		regexps = append(regexps, r)
 	}
-	return compileRegexps(regexps), nil
+	return regexps, scanner.Err()
 }
 
 func buildSubstract(file string) (map[string]bool, error) {
@@ -202,79 +91,161 @@ func buildSubstract(file string) (map[string]bool, error) {
 	scanner := bufio.NewScanner(f)
 	substract := make(map[string]bool)
 	for scanner.Scan() {
-		substract[scanner.Text()] = true
+		substract[scan.CSVKeyOfLine(scanner.Text())] = true
 	}
-	return substract, nil
+	return substract, scanner.Err()
 }
 
-func eachFile(inputPath string, ignorePath []*regexp.Regexp, fn func(path string)) error {
-	err := filepath.Walk(inputPath, func(path string, info os.FileInfo, err error) error {
-		if match, _ := matchRegexps(inputPath, ignorePath); match {
-			return nil
-		}
-		if ! info.Mode().IsRegular() {
-			return err
-		}
-		fn(path)
-		return nil
-	})
-	return err
-}
-
-func mainImplUsingGoroutine(blacklist, whitelist []*regexp.Regexp,
-	inputpath string, ignorePath []*regexp.Regexp, rw ResultWriter) error {
-	b := NewFinder(blacklist, whitelist)
-
+// mainImplUsingGoroutine scans files by jobs workers.
+// Results are written to rw through one goroutine, and rw is flushed before return.
+func mainImplUsingGoroutine(b *scan.Finder, jobs int, inputpath string, w *walker, rw scan.ResultWriter) error {
+	if jobs < 1 {
+		jobs = 1
+	}
+	srw := scan.NewSerialResultWriter(rw)
+	errs := &findErrorCollector{}
 	ch := make(chan string)
 	wg := sync.WaitGroup{}
 	worker := func() {
 		defer wg.Done()
 		for p := range ch {
-			b.Find(p, rw)
+			errs.add(b.Find(p, srw))
 		}
 	}
-	const sizeOfGorotine = 10
-	wg.Add(sizeOfGorotine)
-	for i:=0; i<sizeOfGorotine; i++ {
+	wg.Add(jobs)
+	for i:=0; i<jobs; i++ {
 		go worker()
 	}
-	err := eachFile(inputpath, ignorePath, func(path string) {
+	err := w.eachFile(inputpath, func(path string) {
 		ch <- path
 	})
 	close(ch)
 	wg.Wait()
-	return err
+	errs.add(err)
+	errs.add(srw.Flush())
+	return errs.err()
 }
 
-func mainImplStanderd(blacklist, whitelist []*regexp.Regexp, inputpath string, ignorePath []*regexp.Regexp, rw ResultWriter) error {
-	b := NewFinder(blacklist, whitelist)
-	err := eachFile(inputpath, ignorePath, func(path string) {
-		b.Find(path, rw)
+func mainImplStanderd(b *scan.Finder, inputpath string, w *walker, rw scan.ResultWriter) error {
+	errs := &findErrorCollector{}
+	err := w.eachFile(inputpath, func(path string) {
+		errs.add(b.Find(path, rw))
 	})
-	return err
+	errs.add(err)
+	return errs.err()
 }
 
-func printResult(newPassList io.Reader, result io.Writer, passList map[string]bool) error {
-	scanner := bufio.NewScanner(newPassList)
-	for scanner.Scan() {
-		t := scanner.Text()
-		if _, ok := passList[t]; ok {
+// resultSet is results classified by the pass list and waivers
+type resultSet struct {
+	fresh  []*scan.Result
+	passed []*scan.Result
+	waived []waivedResult
+	// resolved is pass list entries which are not found any more
+	resolved []string
+}
+
+type waivedResult struct {
+	*scan.Result
+	waiver *Waiver
+}
+
+// printResult writes results which are neither in the pass list nor waived,
+// and returns all results classified. Waiver paths are relative to root.
+func printResult(results []*scan.Result, rw scan.ResultWriter, passList map[string]bool, waivers []*Waiver, root string) (*resultSet, error) {
+	now := time.Now()
+	set := &resultSet{fresh: make([]*scan.Result, 0)}
+	found := make(map[string]bool)
+	for _, r := range results {
+		key := r.CSVKey()
+		found[key] = true
+		// waivers count results in the pass list as matched too
+		w := findWaiver(waivers, r, root, now)
+		if _, ok := passList[key]; ok {
+			set.passed = append(set.passed, r)
+			continue
+		}
+		if w != nil {
+			set.waived = append(set.waived, waivedResult{Result: r, waiver: w})
 			continue
 		}
-		fmt.Fprintln(result, t)
+		rw.Write(r)
+		set.fresh = append(set.fresh, r)
+	}
+	for key := range passList {
+		if !found[key] {
+			set.resolved = append(set.resolved, key)
+		}
 	}
-	return nil
+	sort.Strings(set.resolved)
+	for _, p := range waiverProblems(waivers, now) {
+		fmt.Fprintf(os.Stderr, "cw: %s\n", p)
+	}
+	return set, rw.Flush()
 }
 
-func main() {
+// inputRoot is the directory which rule and waiver paths are relative to,
+// which is the parent directory if -i is a file
+func inputRoot(inputPath string) string {
+	if info, err := os.Stat(inputPath); err == nil && !info.IsDir() {
+		return filepath.Dir(inputPath)
+	}
+	return inputPath
+}
+
+func fail(format string, err error) int {
+	fmt.Fprintf(os.Stderr, "cw: "+format+"\n", err)
+	return exitError
+}
+
+func createOutput(path string) (*os.File, error) {
+	if path == "-" {
+		return os.Stdout, nil
+	}
+	return os.Create(path)
+}
+
+func closeOutput(fp *os.File) {
+	if fp != os.Stdout {
+		fp.Close()
+	}
+}
+
+// run returns exitClean if no new findings, exitFound if new findings of -fail-on severity or higher,
+// and exitError if some files could not be scanned or outputs could not be written.
+func run() int {
 	var (
 		inputPath  = flag.String("i", "", "input path")
-		ignorePathFile = flag.String("ignore", "", "ignore path file")
+		ignorePathFile = flag.String("ignore", "", "regexp file of paths relative to -i to ignore, besides .cwignore files")
 		passListFile = flag.String("pass", "", "pass list file")
+		waiverFile = flag.String("waiver", "", "waiver file(yaml or json)")
 		blackListFile = flag.String("black", "", "regexp file(blacklist)")
+		rulesFile = flag.String("rules", "", "rule file(yaml or json) with id, category, severity, exceptions and paths")
+		failOn = flag.String("fail-on", scan.Severities[0], "exit with 1 only if new findings have this severity or higher("+strings.Join(scan.Severities, ", ")+")")
+		grouped = flag.Bool("group", false, "group results by severity and category")
 		whiteListFile = flag.String("white", "", "regexp file(whitelist)")
 		newPathList = flag.String("new_pass_list", "-", "new pass list")
 		result = flag.String("result", "-", "result(new_pass_list - pass_list)")
+		format = flag.String("format", scan.FormatCSV, "result format(csv, jsonl, sarif, junit)")
+		encoding = flag.String("encoding", scan.EncodingASCII, "encodings(ascii, utf8, utf16le, utf16be, all) separated by comma")
+		sections = flag.String("sections", scan.SectionsData, "sections to scan(data, all or glob like .rodata*) separated by comma")
+		excludeSections = flag.String("exclude-sections", "", "sections not to scan(glob like .debug_*) separated by comma")
+		jobs = flag.Int("j", runtime.GOMAXPROCS(0), "number of files scanned in parallel")
+		sorted = flag.Bool("sort", false, "sort results by path and offset")
+		cacheDir = flag.String("cache", "", "cache directory to replay results of files whose contents are unchanged")
+		gitRepo = flag.String("git", "", "git repository to scan files changed between -from and -to instead of -i")
+		gitFrom = flag.String("from", "", "base revision of -git(all files in -to if empty)")
+		gitTo = flag.String("to", "HEAD", "target revision of -git")
+		source = flag.Bool("source", false, "lex C/C++ source files and report string, comment or ident context with line and column")
+		fixDir = flag.String("fix", "", "output directory of ELF files whose new findings are blacked out")
+		htmlReport = flag.String("html", "", "self-contained HTML report of new, waived, passed and resolved findings")
+		minLength = flag.Int("min-length", 1, "minimum characters of tokens in binaries like strings -n")
+		maxSize = flag.String("max-size", "", "skip files larger than this size like 100M")
+		maxDecompressedSize = flag.String("max-decompressed-size", "256M", "maximum size of each decompressed payload, compressed section and zip member, over which files are errors")
+		maxFileSize = flag.String("max-file-size", "1G", "maximum size of files read into memory, over which files are errors unlike -max-size")
+		types = flag.String("types", "", "file types to scan(elf, pe, macho, ar, zip, tar, gzip, bzip2, xz, zstd, bin, archive or compressed) separated by comma")
+		excludeTypes = flag.String("exclude-types", "", "file types not to scan separated by comma")
+		follow = flag.Bool("follow", false, "follow symlinks, skipping loops")
+		minTextRatio = flag.Float64("min-text-ratio", 0, "minimum ratio of letters, digits and spaces of tokens in binaries(0 not to filter), text is usually above 0.8")
 		err error
 	)
 	flag.Parse()
@@ -282,41 +253,214 @@ func main() {
 	var ignorePath []*regexp.Regexp
 	if *ignorePathFile != "" {
 		ignorePath, err = readRegexps(*ignorePathFile)
-		check("-ignore error: %v", err)
+		if err != nil {
+			return fail("-ignore error: %v", err)
+		}
 	}
 
-	blacklist, err := readRegexps(*blackListFile)
+	w := &walker{ignorePath: ignorePath, follow: *follow}
+	if *maxSize != "" {
+		w.maxSize, err = parseSize(*maxSize)
+		if err != nil {
+			return fail("-max-size error: %v", err)
+		}
+	}
+	w.types, err = scan.ParseFileTypeFilter(*types, *excludeTypes)
 	if err != nil {
-		check("-black error: %v", err)
+		return fail("-types error: %v", err)
 	}
-	whitelist, err := readRegexps(*whiteListFile)
-	check("-white error: %v", err)
 
-	fp := os.Stdout
-	if *newPathList != "-" {
-		fp, err = os.Create(*newPathList)
-		check("-new_pass_list error: %v", err)
-		defer fp.Close()
+	var blacklist []*regexp.Regexp
+	if *blackListFile != "" || *rulesFile == "" {
+		blacklist, err = readRegexps(*blackListFile)
+		if err != nil {
+			return fail("-black error: %v", err)
+		}
+	}
+	var rules []*scan.Rule
+	if *rulesFile != "" {
+		rules, err = scan.ReadRules(*rulesFile)
+		if err != nil {
+			return fail("-rules error: %v", err)
+		}
+	}
+	if scan.SeverityRank(*failOn) < 0 {
+		return fail("-fail-on error: %v", fmt.Errorf("unknown severity %q", *failOn))
+	}
+	whitelist, err := readRegexps(*whiteListFile)
+	if err != nil {
+		return fail("-white error: %v", err)
 	}
-	buffer := bytes.NewBuffer(nil)
-	
-	npl := NewResultWriter(io.MultiWriter(fp, buffer))
-	err = mainImplUsingGoroutine(blacklist, whitelist, *inputPath, ignorePath, npl)
-	check("finding err: %v", err)
 
-	rslt := os.Stdout
-	if *result != "-" {
-		rslt, err = os.Create(*result)
-		check("-result error: %v", err)
-		defer rslt.Close()
+	encodings, err := scan.ParseEncodings(*encoding)
+	if err != nil {
+		return fail("-encoding error: %v", err)
+	}
+	b := scan.NewFinder(blacklist, whitelist)
+	b.AddRules(rules)
+	root := ""
+	if *gitRepo == "" {
+		root = inputRoot(*inputPath)
+	}
+	b.SetRoot(root)
+	b.SetEncodings(encodings)
+	b.SetSourceMode(*source)
+	b.SetDump(*htmlReport != "")
+	if *minLength < 1 {
+		return fail("-min-length error: %v", fmt.Errorf("%d is less than 1", *minLength))
+	}
+	if *minTextRatio < 0 || *minTextRatio > 1 {
+		return fail("-min-text-ratio error: %v", fmt.Errorf("%g is not between 0 and 1", *minTextRatio))
+	}
+	b.SetTokenFilter(*minLength, *minTextRatio)
+	maxDecompressed, err := parseSize(*maxDecompressedSize)
+	if err != nil || maxDecompressed == 0 {
+		return fail("-max-decompressed-size error: %v", fmt.Errorf("invalid size %q", *maxDecompressedSize))
+	}
+	b.SetMaxDecompressedSize(maxDecompressed)
+	maxFile, err := parseSize(*maxFileSize)
+	if err != nil || maxFile == 0 {
+		return fail("-max-file-size error: %v", fmt.Errorf("invalid size %q", *maxFileSize))
+	}
+	b.SetMaxFileSize(maxFile)
+	sf, err := scan.ParseSectionFilter(*sections, *excludeSections)
+	if err != nil {
+		return fail("-sections error: %v", err)
+	}
+	b.SetSectionFilter(sf)
+	if *cacheDir != "" && *gitRepo != "" {
+		return fail("-cache error: %v", fmt.Errorf("not supported with -git"))
+	}
+	var cache *scan.Cache
+	if *cacheDir != "" {
+		cache, err = scan.OpenCache(*cacheDir, b.ConfigHash())
+		if err != nil {
+			return fail("-cache error: %v", err)
+		}
+		b.SetCache(cache)
 	}
 
 	var passList map[string]bool
 	if *passListFile != "" {
 		passList, err = buildSubstract(*passListFile)
-		check("-pass error: %v", err)
+		if err != nil {
+			return fail("-pass error: %v", err)
+		}
 	}
 
-	err = printResult(buffer, rslt, passList)
-	check("result error: %v", err)
+	var waivers []*Waiver
+	if *waiverFile != "" {
+		waivers, err = readWaivers(*waiverFile)
+		if err != nil {
+			return fail("-waiver error: %v", err)
+		}
+	}
+
+	fp, err := createOutput(*newPathList)
+	if err != nil {
+		return fail("-new_pass_list error: %v", err)
+	}
+	defer closeOutput(fp)
+	rslt, err := createOutput(*result)
+	if err != nil {
+		return fail("-result error: %v", err)
+	}
+	defer closeOutput(rslt)
+	rrw, err := scan.NewFormatResultWriter(*format, rslt)
+	if err != nil {
+		return fail("-format error: %v", err)
+	}
+
+	collector := &scan.ResultCollector{}
+	var npl scan.ResultWriter = scan.NewResultWriter(fp)
+	if *sorted {
+		npl = scan.NewSortedResultWriter(npl)
+	}
+	var findErr error
+	if *gitRepo != "" {
+		findErr = mainImplGit(b, *gitRepo, *gitFrom, *gitTo, w, scan.MultiResultWriter{npl, collector})
+		if _, ok := findErr.(FindErrors); findErr != nil && !ok {
+			return fail("-git error: %v", findErr)
+		}
+	} else {
+		findErr = mainImplUsingGoroutine(b, *jobs, *inputPath, w, scan.MultiResultWriter{npl, collector})
+	}
+	if *sorted {
+		scan.SortResults(collector.Results)
+	}
+	if cache != nil {
+		fmt.Fprintf(os.Stderr, "cw: cache %s\n", cache)
+	}
+
+	if *grouped {
+		scan.GroupResults(collector.Results)
+	}
+	set, err := printResult(collector.Results, rrw, passList, waivers, root)
+	if err != nil {
+		return fail("-result error: %v", err)
+	}
+	failed := 0
+	for _, r := range set.fresh {
+		if r.Failed(*failOn) {
+			failed++
+		}
+	}
+
+	nErrors := 0
+	if fe, ok := findErr.(FindErrors); ok {
+		nErrors = len(fe)
+		for _, e := range fe {
+			fmt.Fprintf(os.Stderr, "cw: error: %v\n", e)
+		}
+	}
+	// files and tokens are counted before -fix scans the fixed files again
+	files, filtered := b.Files(), b.Filtered()
+	fixFailed := false
+	if *fixDir != "" {
+		summary, err := fixFiles(b, set.fresh, *inputPath, *fixDir)
+		if err != nil {
+			return fail("-fix error: %v", err)
+		}
+		for _, r := range summary.remains {
+			fmt.Fprintf(os.Stderr, "cw: fix: still found: %s\n", r.Message())
+		}
+		fmt.Fprintf(os.Stderr, "cw: fix: %s\n", summary)
+		fixFailed = len(summary.remains) != 0
+	}
+	if *htmlReport != "" {
+		fp, err := createOutput(*htmlReport)
+		if err != nil {
+			return fail("-html error: %v", err)
+		}
+		err = writeHTMLReport(fp, set, files, nErrors)
+		closeOutput(fp)
+		if err != nil {
+			return fail("-html error: %v", err)
+		}
+	}
+	if len(rules) != 0 {
+		for _, g := range scan.SummarizeResults(set.fresh) {
+			fmt.Fprintf(os.Stderr, "cw: %s\n", g)
+		}
+	}
+	fmt.Fprintf(os.Stderr, "cw: %d files, %d findings, %d new findings, %d errors\n",
+		files, len(collector.Results), len(set.fresh), nErrors)
+	if w.skipped != 0 {
+		fmt.Fprintf(os.Stderr, "cw: %d files skipped by -max-size and -types\n", w.skipped)
+	}
+	if *minLength > 1 || *minTextRatio > 0 {
+		fmt.Fprintf(os.Stderr, "cw: %d tokens filtered by -min-length and -min-text-ratio\n", filtered)
+	}
+
+	switch {
+	case nErrors != 0 || fixFailed:
+		return exitError
+	case failed != 0:
+		return exitFound
+	}
+	return exitClean
+}
+
+func main() {
+	os.Exit(run())
 }
@@ -1,25 +1,36 @@
 package main
 
 import(
+	"bytes"
+	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/yoshitake-hamano/gocmd/scan"
 )
 
-var blacklist = compileRegexps([]string{"(?i)hellO", "(?i)wOr"})
-var whitelist = compileRegexps([]string{"WOR"})
-var ignorePath = compileRegexps([]string{"xxx"})
+var blacklist = scan.CompileRegexps([]string{"(?i)hellO", "(?i)wOr"})
+var whitelist = scan.CompileRegexps([]string{"WOR"})
+var ignorePath = scan.CompileRegexps([]string{"xxx"})
 
 func TestOneFile(t *testing.T) {
-	rw := NewResultWriter(os.Stdout)
-	err := mainImplStanderd(blacklist, whitelist, ".", ignorePath, rw)
+	rw := scan.NewResultWriter(os.Stdout)
+	err := mainImplStanderd(scan.NewFinder(blacklist, whitelist), ".", &walker{ignorePath: ignorePath}, rw)
 	if err != nil {
 		t.Fatalf("unexpected err = %W\n", err)
 	}
 }
 
 func TestParentDirectory(t *testing.T) {
-	rw := NewResultWriter(os.Stdout)
-	err := mainImplStanderd(blacklist, whitelist, "../..", ignorePath, rw)
+	rw := scan.NewResultWriter(os.Stdout)
+	err := mainImplStanderd(scan.NewFinder(blacklist, whitelist), "../..", &walker{ignorePath: ignorePath}, rw)
 	if err != nil {
 		t.Fatalf("unexpected err = %W\n", err)
 	}
@@ -28,8 +39,8 @@ func TestParentDirectory(t *testing.T) {
 func BenchmarkStanderd(b *testing.B) {
 	b.ResetTimer()
 	for i:=0; i<b.N; i++ {
-		rw := NewResultWriter(os.Stdout)
-		err := mainImplStanderd(blacklist, whitelist, "../..", ignorePath, rw)
+		rw := scan.NewResultWriter(os.Stdout)
+		err := mainImplStanderd(scan.NewFinder(blacklist, whitelist), "../..", &walker{ignorePath: ignorePath}, rw)
 		if err != nil {
 			b.Fatalf("unexpected err = %v\n", err)
 		}
@@ -39,11 +50,388 @@ func BenchmarkStanderd(b *testing.B) {
 func BenchmarkUsingGoroutine(b *testing.B) {
 	b.ResetTimer()
 	for i:=0; i<b.N; i++ {
-		rw := NewResultWriter(os.Stdout)
-		err := mainImplUsingGoroutine(blacklist, whitelist, "../..", ignorePath, rw)
+		rw := scan.NewResultWriter(os.Stdout)
+		err := mainImplUsingGoroutine(scan.NewFinder(blacklist, whitelist), runtime.GOMAXPROCS(0), "../..", &walker{ignorePath: ignorePath}, rw)
 		if err != nil {
 			b.Fatalf("unexpected err = %v\n", err)
 		}
 	}
 }
 
+func TestWaiver(t *testing.T) {
+	w := &Waiver{Path: "bundle.zip!lib/**", Keyword: "(?i)hellO", Text: "^Hello", Owner: "o", Reason: "r", Expires: "2021-12-31"}
+	if err := w.compile(); err != nil {
+		t.Fatalf("unexpected err = %v\n", err)
+	}
+	var tests = []struct {
+		r      *scan.Result
+		root   string
+		now    string
+		expect bool
+	}{
+		{r: &scan.Result{Path: "bundle.zip!lib/libfoo.a!foo.o", Keyword: "(?i)hellO", Text: "Hello World"}, now: "2021-12-31", expect: true},
+		{r: &scan.Result{Path: "bundle.zip!lib/libfoo.a!foo.o", Keyword: "(?i)hellO", Text: "Hello World"}, now: "2022-01-01", expect: false},
+		{r: &scan.Result{Path: "bundle.zip!bin/foo", Keyword: "(?i)hellO", Text: "Hello World"}, now: "2021-01-01", expect: false},
+		{r: &scan.Result{Path: "bundle.zip!lib/libfoo.a!foo.o", Keyword: "(?i)wOr", Text: "Hello World"}, now: "2021-01-01", expect: false},
+		{r: &scan.Result{Path: "bundle.zip!lib/libfoo.a!foo.o", Keyword: "(?i)hellO", Text: "say Hello"}, now: "2021-01-01", expect: false},
+		{r: &scan.Result{Path: "out/bundle.zip!lib/libfoo.a!foo.o", Keyword: "(?i)hellO", Text: "Hello World"}, root: "out", now: "2021-01-01", expect: true},
+		{r: &scan.Result{Path: "out/bundle.zip!lib/libfoo.a!foo.o", Keyword: "(?i)hellO", Text: "Hello World"}, root: "", now: "2021-01-01", expect: false},
+	}
+	for i, test := range tests {
+		now, _ := time.Parse(waiverDateLayout, test.now)
+		if actual := findWaiver([]*Waiver{w}, test.r, test.root, now) != nil; actual != test.expect {
+			t.Fatalf("tests[%d]: expected = %v, actual = %v\n", i, test.expect, actual)
+		}
+	}
+	now, _ := time.Parse(waiverDateLayout, "2022-01-01")
+	unused := &Waiver{Path: "nothing", Owner: "o", Reason: "r", Expires: "2099-01-01"}
+	unused.compile()
+	if problems := waiverProblems([]*Waiver{w, unused}, now); len(problems) != 2 {
+		t.Fatalf("expected expired and unused waivers, actual = %v\n", problems)
+	}
+
+	passed := &scan.Result{Path: "a.bin", Keyword: "(?i)hellO", Text: "Hello"}
+	waiver := &Waiver{Keyword: "(?i)hellO", Owner: "o", Reason: "r", Expires: "2099-01-01"}
+	waiver.compile()
+	set, err := printResult([]*scan.Result{passed}, &scan.DummyResultWriter{}, map[string]bool{passed.CSVKey(): true}, []*Waiver{waiver}, "")
+	if err != nil || len(set.passed) != 1 || waiver.matched != 1 {
+		t.Fatalf("waivers should match results in the pass list, actual = %v(%d matched)\n", err, waiver.matched)
+	}
+}
+
+func TestLegacyPassList(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// pass lists written before -encoding have no encoding field
+	filename := filepath.Join(dir, "passList.txt")
+	if err := ioutil.WriteFile(filename, []byte("a.bin,bin,,(?i)hellO,Hello\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	passList, err := buildSubstract(filename)
+	if err != nil {
+		t.Fatalf("unexpected err = %v\n", err)
+	}
+	rw := &scan.ResultCollector{}
+	b := scan.NewFinder(blacklist, whitelist)
+	if err := b.FindData("a.bin", []byte("\x00Hello\x00"), rw); err != nil {
+		t.Fatalf("unexpected err = %v\n", err)
+	}
+	set, err := printResult(rw.Results, &scan.DummyResultWriter{}, passList, nil, "")
+	if err != nil || len(set.fresh) != 0 || len(set.passed) != 1 || len(set.resolved) != 0 {
+		t.Fatalf("unexpected classification = %+v, %v\n", set, err)
+	}
+}
+
+func TestEachFile(t *testing.T) {
+	err := (&walker{ignorePath: scan.CompileRegexps([]string{"_test\\.go$"})}).eachFile(".", func(path string) {
+		if strings.HasSuffix(path, "_test.go") {
+			t.Fatalf("ignored path is passed: %s\n", path)
+		}
+	})
+	if err != nil {
+		t.Fatalf("unexpected err = %v\n", err)
+	}
+
+	err = mainImplStanderd(scan.NewFinder(blacklist, whitelist), "nofile", &walker{ignorePath: ignorePath}, &scan.ResultCollector{})
+	if fe, ok := err.(FindErrors); !ok || len(fe) != 1 {
+		t.Fatalf("expected FindErrors, actual = %v\n", err)
+	}
+}
+
+func TestWalker(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	files := map[string]string{
+		".cwignore":         "# comment\n*.log\nbuild/\n/top.txt\n",
+		"top.txt":           "top",
+		"a.log":             "log",
+		"a.elf":             "\x7fELF",
+		"big.bin":           strings.Repeat("x", 100),
+		"build/out.txt":     "build",
+		"src/top.txt":       "not anchored",
+		"src/.cwignore":     "!keep.log\n**/gen/*.c\n",
+		"src/keep.log":      "log",
+		"src/x/gen/a.c":     "generated",
+		"src/x/gen/a.h":     "header",
+		"src/x/archive.zip": "PK\x03\x04",
+	}
+	for name, body := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(body), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("..", filepath.Join(dir, "src", "loop")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join("..", "a.elf"), filepath.Join(dir, "src", "link.elf")); err != nil {
+		t.Fatal(err)
+	}
+
+	walk := func(w *walker) string {
+		paths := make([]string, 0)
+		if err := w.eachFile(dir, func(path string) {
+			rel, _ := filepath.Rel(dir, path)
+			paths = append(paths, filepath.ToSlash(rel))
+		}); err != nil {
+			t.Fatalf("unexpected err = %v\n", err)
+		}
+		return strings.Join(paths, ",")
+	}
+	expect := ".cwignore,a.elf,big.bin,src/.cwignore,src/keep.log,src/top.txt,src/x/archive.zip,src/x/gen/a.h"
+	if actual := walk(&walker{}); actual != expect {
+		t.Fatalf("expected = %s, actual = %s\n", expect, actual)
+	}
+	expect = "a.elf,src/link.elf,src/x/archive.zip"
+	types, _ := scan.ParseFileTypeFilter("elf,archive", "")
+	w := &walker{maxSize: 50, types: types, follow: true}
+	if actual := walk(w); actual != expect || w.skipped != 6 {
+		t.Fatalf("expected = %s, actual = %s(%d skipped)\n", expect, actual, w.skipped)
+	}
+	if _, err := scan.ParseFileTypeFilter("exe", ""); err == nil {
+		t.Fatalf("expected unknown file type error\n")
+	}
+	if n, err := parseSize("100M"); err != nil || n != 100<<20 {
+		t.Fatalf("unexpected size = %d, %v\n", n, err)
+	}
+}
+
+func TestSortedOutput(t *testing.T) {
+	run := func() string {
+		buf := bytes.NewBuffer(nil)
+		rw := scan.NewSortedResultWriter(scan.NewResultWriter(buf))
+		err := mainImplUsingGoroutine(scan.NewFinder(blacklist, whitelist), 4, ".", &walker{ignorePath: ignorePath}, rw)
+		if err != nil {
+			t.Fatalf("unexpected err = %v\n", err)
+		}
+		return buf.String()
+	}
+	first := run()
+	for i := 0; i < 3; i++ {
+		if second := run(); first != second {
+			t.Fatalf("output differs between runs\n%s\n%s\n", first, second)
+		}
+	}
+}
+
+func TestCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	run := func() (string, *scan.Cache) {
+		b := scan.NewFinder(blacklist, whitelist)
+		c, err := scan.OpenCache(dir, b.ConfigHash())
+		if err != nil {
+			t.Fatalf("unexpected err = %v\n", err)
+		}
+		b.SetCache(c)
+		buf := bytes.NewBuffer(nil)
+		err = mainImplUsingGoroutine(b, 4, ".", &walker{ignorePath: ignorePath}, scan.NewSortedResultWriter(scan.NewResultWriter(buf)))
+		if err != nil {
+			t.Fatalf("unexpected err = %v\n", err)
+		}
+		return buf.String(), c
+	}
+	first, c := run()
+	if !strings.HasPrefix(c.String(), "0 hits,") {
+		t.Fatalf("expected no cache hit, actual = %s\n", c)
+	}
+	second, c := run()
+	if !strings.HasSuffix(c.String(), " 0 misses") {
+		t.Fatalf("expected no cache miss, actual = %s\n", c)
+	}
+	if first != second {
+		t.Fatalf("cached results differ\n%s\n%s\n", first, second)
+	}
+}
+
+func TestGit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	repo, err := git.PlainInit(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wt, err := repo.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	commit := func(author string, files map[string]string) string {
+		for name, body := range files {
+			if err := os.MkdirAll(filepath.Join(dir, filepath.Dir(name)), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(body), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := wt.Add(name); err != nil {
+				t.Fatal(err)
+			}
+		}
+		sig := &object.Signature{Name: author, Email: author + "@example.com", When: time.Now()}
+		hash, err := wt.Commit(author, &git.CommitOptions{Author: sig})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return hash.String()
+	}
+	base := commit("base", map[string]string{"a.txt": "\x00Hello old\x00"})
+	alice := commit("alice", map[string]string{"a.txt": "\x00Hello old\x00Hello new\x00", "b.txt": "\x00World\x00"})
+	bob := commit("bob", map[string]string{"c.txt": "\x00Hello bob\x00"})
+	// files are selected like the walker with .cwignore files in the target revision
+	commit("carol", map[string]string{
+		".cwignore":     "*.log\nbuild/\n",
+		"x.log":         "\x00Hello log\x00",
+		"build/y.txt":   "\x00Hello build\x00",
+		"lib/.cwignore": "z.txt\n",
+		"lib/z.txt":     "\x00Hello lib\x00",
+		"big.txt":       "\x00Hello big\x00" + strings.Repeat("\x00", 100),
+	})
+
+	rw := &scan.ResultCollector{}
+	b := scan.NewFinder(blacklist, whitelist)
+	w := &walker{ignorePath: ignorePath, maxSize: 100}
+	if err := mainImplGit(b, dir, base, "HEAD", w, rw); err != nil {
+		t.Fatalf("unexpected err = %v\n", err)
+	}
+	if b.Files() != 5 || w.skipped != 1 {
+		t.Fatalf("expected 5 files and 1 skipped, actual = %d, %d\n", b.Files(), w.skipped)
+	}
+	scan.SortResults(rw.Results)
+	actual := make([]string, 0)
+	for _, r := range rw.Results {
+		actual = append(actual, fmt.Sprintf("%s,%s,%s,%s", r.Path, r.Text, r.Commit, r.Author))
+	}
+	expect := []string{
+		"a.txt,Hello old,,",
+		"a.txt,Hello new," + alice + ",alice <alice@example.com>",
+		"b.txt,World," + alice + ",alice <alice@example.com>",
+		"c.txt,Hello bob," + bob + ",bob <bob@example.com>",
+	}
+	if strings.Join(actual, "\n") != strings.Join(expect, "\n") {
+		t.Fatalf("expected = %v, actual = %v\n", expect, actual)
+	}
+}
+
+func TestHTMLReport(t *testing.T) {
+	b := scan.NewFinder(blacklist, whitelist)
+	b.SetDump(true)
+	rw := &scan.ResultCollector{}
+	b.FindData("a.bin", []byte("\x00\x01Hello\x00World\x00"), rw)
+	if len(rw.Results) != 2 {
+		t.Fatalf("expected 2 results, actual = %v\n", rw.Results)
+	}
+	if r := rw.Results[0]; r.DumpOffset != 0 || !bytes.Equal(r.Dump, []byte("\x00\x01Hello\x00World\x00")) {
+		t.Fatalf("unexpected dump = %q from %d\n", r.Dump, r.DumpOffset)
+	}
+
+	passList := map[string]bool{
+		rw.Results[0].CSVKey():              true,
+		"a.bin,bin,,ascii,(?i)hellO,Goodbye": true,
+	}
+	waivers := []*Waiver{{ID: "w1", Keyword: "(?i)wOr", Owner: "me", Reason: "approved", Expires: "2099-12-31"}}
+	waivers[0].compile()
+	set, err := printResult(rw.Results, &scan.DummyResultWriter{}, passList, waivers, "")
+	if err != nil {
+		t.Fatalf("unexpected err = %v\n", err)
+	}
+	if len(set.fresh) != 0 || len(set.passed) != 1 || len(set.waived) != 1 || len(set.resolved) != 1 {
+		t.Fatalf("unexpected classification = %+v\n", set)
+	}
+
+	buf := bytes.NewBuffer(nil)
+	if err := writeHTMLReport(buf, set, 1, 0); err != nil {
+		t.Fatalf("unexpected err = %v\n", err)
+	}
+	html := buf.String()
+	for _, expect := range []string{
+		"New findings (0)",
+		"Waived findings (1)",
+		"Waived by w1: approved",
+		"Resolved findings (1)",
+		"Goodbye",
+		"00000000: 00 01 <mark>48</mark>",
+	} {
+		if !strings.Contains(html, expect) {
+			t.Fatalf("%q is not in the report\n", expect)
+		}
+	}
+	if strings.Contains(html, "<script") || strings.Contains(html, "<link") {
+		t.Fatalf("the report should be self-contained\n")
+	}
+}
+
+var fixMarker = "\x00cwFixMarkerXyzzy\x00"
+
+func TestFix(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("the test binary is not ELF")
+	}
+	dir, err := ioutil.TempDir("", "cw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	b := scan.NewFinder(scan.CompileRegexps([]string{"FixMarker"}), nil)
+	rw := &scan.ResultCollector{}
+	if err := b.Find(os.Args[0], rw); err != nil {
+		t.Fatalf("unexpected err = %v\n", err)
+	}
+	if len(rw.Results) == 0 {
+		t.Fatalf("%q is not found in the test binary\n", fixMarker)
+	}
+	summary, err := fixFiles(b, rw.Results, filepath.Dir(os.Args[0]), dir)
+	if err != nil {
+		t.Fatalf("unexpected err = %v\n", err)
+	}
+	if summary.files != 1 || summary.fixed != len(rw.Results) || len(summary.remains) != 0 {
+		t.Fatalf("unexpected summary = %s\n", summary)
+	}
+
+	original, _ := ioutil.ReadFile(os.Args[0])
+	fixed, err := ioutil.ReadFile(filepath.Join(dir, filepath.Base(os.Args[0])))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(fixed, []byte("FixMarker")) || !bytes.Contains(fixed, []byte("cw*********Xyzzy")) {
+		t.Fatalf("the marker is not blacked out\n")
+	}
+	if len(original) != len(fixed) {
+		t.Fatalf("size changed(before %d, after %d)\n", len(original), len(fixed))
+	}
+
+	var tests = []struct {
+		inputPath string
+		path      string
+		expect    string
+	}{
+		{inputPath: "../build", path: "../build/bin/a", expect: "out/bin/a"},
+		{inputPath: "../build/bin/a", path: "../build/bin/a", expect: "out/a"},
+		{inputPath: "", path: "bin/a", expect: "out/bin/a"},
+		{inputPath: "", path: "../bin/a", expect: ""},
+		{inputPath: "build", path: "other/a", expect: ""},
+	}
+	for _, test := range tests {
+		actual, err := fixPath(test.inputPath, test.path, "out")
+		if (err != nil) != (test.expect == "") || actual != filepath.FromSlash(test.expect) {
+			t.Fatalf("%s in %s: expected = %q, actual = %q(%v)\n", test.path, test.inputPath, test.expect, actual, err)
+		}
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/yoshitake-hamano/gocmd/scan"
+)
+
+type dumpCell struct {
+	Hex  string
+	Char string
+	Hit  bool
+}
+
+type dumpLine struct {
+	Offset string
+	Cells  []dumpCell
+	// Pad aligns the characters of the last line
+	Pad string
+}
+
+// hexdump returns the dump like "xxd" with the bytes of the result marked
+func hexdump(r *scan.Result) []dumpLine {
+	lines := make([]dumpLine, 0)
+	hitStart := r.Offset - r.DumpOffset
+	hitEnd := hitStart + int64(r.ByteLength())
+	for i := 0; i < len(r.Dump); i += scan.DumpLineSize {
+		line := dumpLine{Offset: fmt.Sprintf("%08x", r.DumpOffset+int64(i))}
+		for j := i; j < i+scan.DumpLineSize && j < len(r.Dump); j++ {
+			c := r.Dump[j]
+			char := "."
+			if 0x20 <= c && c < 0x7f {
+				char = string(rune(c))
+			}
+			hit := hitStart <= int64(j) && int64(j) < hitEnd
+			line.Cells = append(line.Cells, dumpCell{Hex: fmt.Sprintf("%02x", c), Char: char, Hit: hit})
+		}
+		line.Pad = strings.Repeat("   ", scan.DumpLineSize-len(line.Cells))
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+type reportCount struct {
+	Name   string
+	New    int
+	Waived int
+	Passed int
+}
+
+type reportCounts struct {
+	Title string
+	Rows  []*reportCount
+}
+
+// countResults counts results per name returned by key
+func countResults(title string, set *resultSet, key func(r *scan.Result) string) reportCounts {
+	counts := make(map[string]*reportCount)
+	get := func(r *scan.Result) *reportCount {
+		name := key(r)
+		c, ok := counts[name]
+		if !ok {
+			c = &reportCount{Name: name}
+			counts[name] = c
+		}
+		return c
+	}
+	for _, r := range set.fresh {
+		get(r).New++
+	}
+	for _, w := range set.waived {
+		get(w.Result).Waived++
+	}
+	for _, r := range set.passed {
+		get(r).Passed++
+	}
+	rc := reportCounts{Title: title}
+	for _, c := range counts {
+		rc.Rows = append(rc.Rows, c)
+	}
+	sort.Slice(rc.Rows, func(i, j int) bool {
+		a, b := rc.Rows[i], rc.Rows[j]
+		if a.New != b.New {
+			return a.New > b.New
+		}
+		return a.Name < b.Name
+	})
+	return rc
+}
+
+type reportFinding struct {
+	*scan.Result
+	Message string
+	Dump    []dumpLine
+	Waiver  *Waiver
+}
+
+type report struct {
+	Generated string
+	Files     int64
+	Errors    int
+	Counts    []reportCounts
+	New       []reportFinding
+	Waived    []reportFinding
+	Passed    []reportFinding
+	Resolved  []string
+}
+
+func newReportFinding(r *scan.Result, w *Waiver) reportFinding {
+	return reportFinding{Result: r, Message: r.Message(), Dump: hexdump(r), Waiver: w}
+}
+
+func newReport(set *resultSet, files int64, errors int, now time.Time) *report {
+	rp := &report{
+		Generated: now.Format(time.RFC3339),
+		Files:     files,
+		Errors:    errors,
+		Counts: []reportCounts{
+			countResults("Keyword", set, func(r *scan.Result) string { return r.Keyword }),
+			countResults("File", set, func(r *scan.Result) string { return r.Path }),
+			countResults("Section", set, func(r *scan.Result) string {
+				if r.Section == "" {
+					return "(" + r.FileType + ")"
+				}
+				return r.Section
+			}),
+		},
+		Resolved: set.resolved,
+	}
+	for _, r := range set.fresh {
+		rp.New = append(rp.New, newReportFinding(r, nil))
+	}
+	for _, w := range set.waived {
+		rp.Waived = append(rp.Waived, newReportFinding(w.Result, w.waiver))
+	}
+	for _, r := range set.passed {
+		rp.Passed = append(rp.Passed, newReportFinding(r, nil))
+	}
+	return rp
+}
+
+// writeHTMLReport writes the report without any external assets
+func writeHTMLReport(w io.Writer, set *resultSet, files int64, errors int) error {
+	return reportTemplate.Execute(w, newReport(set, files, errors, time.Now()))
+}
+
+var reportTemplate = template.Must(template.New("report").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>cw report</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 1em; }
+th, td { border: 1px solid #ccc; padding: 2px 8px; text-align: left; vertical-align: top; }
+td.n { text-align: right; }
+.new { color: #b00020; }
+.waived { color: #8a6d00; }
+.passed { color: #555; }
+.resolved { color: #1b5e20; }
+pre.dump { background: #f6f6f6; padding: 4px; }
+pre.dump mark { background: #ffd54f; }
+.counts { display: flex; gap: 2em; flex-wrap: wrap; }
+</style>
+</head>
+<body>
+<h1>cw report</h1>
+<p>Generated at {{.Generated}}, {{.Files}} files, {{.Errors}} errors.</p>
+<table>
+<tr><th class="new">New</th><th class="waived">Waived</th><th class="passed">Passed</th><th class="resolved">Resolved</th></tr>
+<tr><td class="n">{{len .New}}</td><td class="n">{{len .Waived}}</td><td class="n">{{len .Passed}}</td><td class="n">{{len .Resolved}}</td></tr>
+</table>
+
+<div class="counts">
+{{range .Counts}}<div>
+<h3>{{.Title}}</h3>
+<table>
+<tr><th>{{.Title}}</th><th class="new">New</th><th class="waived">Waived</th><th class="passed">Passed</th></tr>
+{{range .Rows}}<tr><td>{{.Name}}</td><td class="n">{{.New}}</td><td class="n">{{.Waived}}</td><td class="n">{{.Passed}}</td></tr>
+{{end}}</table>
+</div>
+{{end}}</div>
+
+{{define "finding"}}<div>
+<h4>{{.Path}} {{.Section}}</h4>
+<p>{{.Message}}</p>
+{{with .Waiver}}<p>Waived by {{.}}: {{.Reason}} (owner {{.Owner}}, expires {{.Expires}})</p>
+{{end}}{{if .Dump}}<pre class="dump">{{range .Dump}}{{.Offset}}: {{range .Cells}}{{if .Hit}}<mark>{{.Hex}}</mark>{{else}}{{.Hex}}{{end}} {{end}}{{.Pad}} {{range .Cells}}{{if .Hit}}<mark>{{.Char}}</mark>{{else}}{{.Char}}{{end}}{{end}}
+{{end}}</pre>
+{{end}}</div>
+{{end}}
+
+<h2 class="new">New findings ({{len .New}})</h2>
+{{range .New}}{{template "finding" .}}{{end}}
+
+<h2 class="waived">Waived findings ({{len .Waived}})</h2>
+{{range .Waived}}{{template "finding" .}}{{end}}
+
+<h2 class="resolved">Resolved findings ({{len .Resolved}})</h2>
+<p>Entries of the pass list which are not found any more.</p>
+<ul>
+{{range .Resolved}}<li><code>{{.}}</code></li>
+{{end}}</ul>
+
+<details>
+<summary class="passed">Passed findings ({{len .Passed}})</summary>
+{{range .Passed}}{{template "finding" .}}{{end}}
+</details>
+</body>
+</html>
+`))
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/yoshitake-hamano/gocmd/config"
+	"github.com/yoshitake-hamano/gocmd/scan"
+)
+
+const waiverDateLayout = "2006-01-02"
+
+// Waiver approves results matched by path glob relative to -i, keyword and text regexp.
+//
+//   waivers:
+//     - id: hello-in-libfoo
+//       path: "bundle.zip!lib/**"
+//       keyword: "(?i)hellO"
+//       text: "^Hello World$"
+//       owner: yoshitake
+//       reason: greeting message approved by customer
+//       expires: 2021-12-31
+type Waiver struct {
+	ID      string `yaml:"id" json:"id"`
+	Path    string `yaml:"path" json:"path"`
+	Keyword string `yaml:"keyword" json:"keyword"`
+	Text    string `yaml:"text" json:"text"`
+	Owner   string `yaml:"owner" json:"owner"`
+	Reason  string `yaml:"reason" json:"reason"`
+	Expires string `yaml:"expires" json:"expires"`
+
+	path    *regexp.Regexp
+	text    *regexp.Regexp
+	expires time.Time
+	matched int
+}
+
+type waiverFile struct {
+	Waivers []*Waiver `yaml:"waivers" json:"waivers"`
+}
+
+func (w *Waiver) String() string {
+	if w.ID != "" {
+		return w.ID
+	}
+	return fmt.Sprintf("path=%q keyword=%q text=%q", w.Path, w.Keyword, w.Text)
+}
+
+func (w *Waiver) compile() error {
+	if w.Owner == "" || w.Reason == "" || w.Expires == "" {
+		return fmt.Errorf("owner, reason and expires are required")
+	}
+	var err error
+	w.expires, err = time.Parse(waiverDateLayout, w.Expires)
+	if err != nil {
+		return fmt.Errorf("expires: %w", err)
+	}
+	if w.Path != "" {
+		w.path, err = scan.CompileGlob(w.Path)
+		if err != nil {
+			return fmt.Errorf("path: %w", err)
+		}
+	}
+	if w.Text != "" {
+		w.text, err = regexp.Compile(w.Text)
+		if err != nil {
+			return fmt.Errorf("text: %w", err)
+		}
+	}
+	return nil
+}
+
+// match reports whether the waiver matches r, whose path is relative to the input directory
+func (w *Waiver) match(r *scan.Result, path string) bool {
+	if w.path != nil && !w.path.MatchString(path) {
+		return false
+	}
+	if w.Keyword != "" && w.Keyword != r.Keyword {
+		return false
+	}
+	if w.text != nil && !w.text.MatchString(r.Text) {
+		return false
+	}
+	return true
+}
+
+// expired reports whether the waiver is expired. It is valid through the expiry date.
+func (w *Waiver) expired(now time.Time) bool {
+	return !now.Before(w.expires.AddDate(0, 0, 1))
+}
+
+// readWaivers reads JSON if the extension is .json, otherwise YAML
+func readWaivers(filename string) ([]*Waiver, error) {
+	wf := waiverFile{}
+	if err := config.Read(filename, &wf); err != nil {
+		return nil, fmt.Errorf("read waivers: %w", err)
+	}
+	for i, w := range wf.Waivers {
+		if err := w.compile(); err != nil {
+			return nil, fmt.Errorf("read waivers: %s: waivers[%d]: %w", filename, i, err)
+		}
+	}
+	return wf.Waivers, nil
+}
+
+// findWaiver returns the first valid waiver which matches r.
+// Waiver paths are relative to root like rule paths.
+// Expired waivers are counted as matched, but do not approve r.
+func findWaiver(waivers []*Waiver, r *scan.Result, root string, now time.Time) *Waiver {
+	var found *Waiver
+	path := scan.RelPath(root, r.Path)
+	for _, w := range waivers {
+		if !w.match(r, path) {
+			continue
+		}
+		w.matched++
+		if found == nil && !w.expired(now) {
+			found = w
+		}
+	}
+	return found
+}
+
+// waiverProblems returns expired waivers and waivers which match nothing
+func waiverProblems(waivers []*Waiver, now time.Time) []string {
+	problems := make([]string, 0)
+	for _, w := range waivers {
+		if w.expired(now) {
+			problems = append(problems, fmt.Sprintf("waiver expired on %s: %s (owner %s)", w.Expires, w, w.Owner))
+		}
+		if w.matched == 0 {
+			problems = append(problems, fmt.Sprintf("waiver matches nothing: %s (owner %s)", w, w.Owner))
+		}
+	}
+	return problems
+}
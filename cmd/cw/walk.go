@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/yoshitake-hamano/gocmd/scan"
+)
+
+// cwignoreName is the name of gitignore style files discovered per directory
+const cwignoreName = ".cwignore"
+
+// ignorePattern is a line of .cwignore
+type ignorePattern struct {
+	re      *regexp.Regexp
+	negate  bool
+	dirOnly bool
+	// anchored patterns contain "/", and match the path relative to the .cwignore.
+	// The others match the base name at any depth.
+	anchored bool
+	// anyDir is the leading "**/" of an anchored pattern
+	anyDir bool
+}
+
+func (p *ignorePattern) match(rel string, isDir bool) bool {
+	if p.dirOnly && !isDir {
+		return false
+	}
+	if !p.anchored {
+		return p.re.MatchString(rel[strings.LastIndex(rel, "/")+1:])
+	}
+	if p.re.MatchString(rel) {
+		return true
+	}
+	for i := 0; p.anyDir && i < len(rel); i++ {
+		if rel[i] == '/' && p.re.MatchString(rel[i+1:]) {
+			return true
+		}
+	}
+	return false
+}
+
+// cwignore is the patterns of a .cwignore
+type cwignore struct {
+	// rel is the directory of the .cwignore relative to the root, or empty for the root
+	rel      string
+	patterns []*ignorePattern
+}
+
+func parseCwignore(rel string, data []byte) (*cwignore, error) {
+	c := &cwignore{rel: rel}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimRight(scanner.Text(), " \t\r")
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		p := &ignorePattern{}
+		if strings.HasPrefix(text, "!") {
+			p.negate = true
+			text = text[1:]
+		} else if strings.HasPrefix(text, `\`) {
+			text = text[1:]
+		}
+		if strings.HasSuffix(text, "/") {
+			p.dirOnly = true
+			text = strings.TrimRight(text, "/")
+		}
+		if strings.Contains(text, "/") {
+			p.anchored = true
+			text = strings.TrimPrefix(text, "/")
+		}
+		if strings.HasPrefix(text, "**/") {
+			p.anyDir = true
+			text = text[len("**/"):]
+		}
+		re, err := scan.CompileGlob(text)
+		if err != nil {
+			return nil, fmt.Errorf("%d: %w", line, err)
+		}
+		p.re = re
+		c.patterns = append(c.patterns, p)
+	}
+	return c, scanner.Err()
+}
+
+// readCwignore reads .cwignore in dir, or returns nil if not exists
+func readCwignore(dir, rel string) (*cwignore, error) {
+	path := filepath.Join(dir, cwignoreName)
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	c, err := parseCwignore(rel, data)
+	if err != nil {
+		return nil, fmt.Errorf("%s:%w", path, err)
+	}
+	return c, nil
+}
+
+// match returns whether rel is ignored by the last matching pattern, and whether any pattern matches.
+// rel is relative to the root.
+func (c *cwignore) match(rel string, isDir bool) (bool, bool) {
+	if c.rel != "" {
+		rel = strings.TrimPrefix(rel, c.rel+"/")
+	}
+	ignored, matched := false, false
+	for _, p := range c.patterns {
+		if p.match(rel, isDir) {
+			ignored, matched = !p.negate, true
+		}
+	}
+	return ignored, matched
+}
+
+// parseSize parses bytes with an optional suffix K, M or G like "100M"
+func parseSize(s string) (int64, error) {
+	unit := int64(1)
+	switch {
+	case strings.HasSuffix(s, "K"):
+		unit = 1 << 10
+	case strings.HasSuffix(s, "M"):
+		unit = 1 << 20
+	case strings.HasSuffix(s, "G"):
+		unit = 1 << 30
+	}
+	if unit != 1 {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return n * unit, nil
+}
+
+// walker selects files to scan
+type walker struct {
+	// ignorePath matches paths relative to the root
+	ignorePath []*regexp.Regexp
+	// maxSize skips larger files if positive
+	maxSize int64
+	types   *scan.FileTypeFilter
+	// follow follows symlinks, and skips directories which are already on the way to avoid loops
+	follow bool
+	// skipped counts files skipped by maxSize and types
+	skipped int
+}
+
+// ignored returns whether rel is ignored by ignorePath or .cwignore files from the root to the parent
+func (w *walker) ignored(rel string, isDir bool, ignores []*cwignore) bool {
+	if match, _ := scan.MatchRegexps(rel, w.ignorePath); match {
+		return true
+	}
+	ignored := false
+	for _, c := range ignores {
+		if i, ok := c.match(rel, isDir); ok {
+			ignored = i
+		}
+	}
+	return ignored
+}
+
+// selectContent returns whether a regular file of size has the size and the file type to scan.
+// readHead returns the leading bytes of the file, and is called only if -types is given.
+func (w *walker) selectContent(size int64, readHead func() ([]byte, error)) (bool, error) {
+	if w.maxSize > 0 && size > w.maxSize {
+		w.skipped++
+		return false, nil
+	}
+	if w.types == nil || w.types.All() {
+		return true, nil
+	}
+	magic, err := readHead()
+	if err != nil {
+		return false, err
+	}
+	if !w.types.Match(scan.DetectFileType(magic)) {
+		w.skipped++
+		return false, nil
+	}
+	return true, nil
+}
+
+// readMagic reads the leading bytes of r which scan.DetectFileType needs
+func readMagic(r io.Reader) ([]byte, error) {
+	magic := make([]byte, scan.MagicSize)
+	n, err := io.ReadFull(r, magic)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	return magic[:n], nil
+}
+
+// selectFile returns whether the regular file has the size and the file type to scan
+func (w *walker) selectFile(path string, info os.FileInfo) (bool, error) {
+	return w.selectContent(info.Size(), func() ([]byte, error) {
+		fp, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer fp.Close()
+		return readMagic(fp)
+	})
+}
+
+func (w *walker) walk(path, rel string, info os.FileInfo, ignores []*cwignore, ancestors []os.FileInfo, errs *findErrorCollector, fn func(path string)) {
+	if !info.IsDir() {
+		if !info.Mode().IsRegular() {
+			return
+		}
+		ok, err := w.selectFile(path, info)
+		errs.add(err)
+		if ok {
+			fn(path)
+		}
+		return
+	}
+	for _, a := range ancestors {
+		if os.SameFile(a, info) {
+			return
+		}
+	}
+	ancestors = append(ancestors[:len(ancestors):len(ancestors)], info)
+
+	c, err := readCwignore(path, rel)
+	if err != nil {
+		errs.add(err)
+	} else if c != nil {
+		ignores = append(ignores[:len(ignores):len(ignores)], c)
+	}
+	fp, err := os.Open(path)
+	if err != nil {
+		errs.add(err)
+		return
+	}
+	names, err := fp.Readdirnames(-1)
+	fp.Close()
+	if err != nil {
+		errs.add(err)
+		return
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		childPath := filepath.Join(path, name)
+		childRel := name
+		if rel != "" {
+			childRel = rel + "/" + name
+		}
+		fi, err := os.Lstat(childPath)
+		if err != nil {
+			errs.add(err)
+			continue
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			if !w.follow {
+				continue
+			}
+			if fi, err = os.Stat(childPath); err != nil {
+				errs.add(err)
+				continue
+			}
+		}
+		if w.ignored(childRel, fi.IsDir(), ignores) {
+			continue
+		}
+		w.walk(childPath, childRel, fi, ignores, ancestors, errs, fn)
+	}
+}
+
+// eachFile calls fn for each regular file selected by w in lexical order.
+// The root itself is never ignored.
+// It continues walking on errors, and returns them as FindErrors.
+func (w *walker) eachFile(inputPath string, fn func(path string)) error {
+	errs := &findErrorCollector{}
+	info, err := os.Stat(inputPath)
+	if err != nil {
+		errs.add(err)
+		return errs.err()
+	}
+	w.walk(inputPath, "", info, nil, nil, errs, fn)
+	return errs.err()
+}
@@ -0,0 +1,47 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type testFile struct {
+	Names []string `yaml:"names" json:"names"`
+}
+
+func TestRead(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var tests = []struct {
+		name   string
+		body   string
+		expect int
+		fail   bool
+	}{
+		{name: "a.yaml", body: "names: [a, b]\n", expect: 2},
+		{name: "a.JSON", body: `{"names": ["a"]}`, expect: 1},
+		{name: "b.yaml", body: "names: [a]\nnmaes: [b]\n", fail: true},
+		{name: "b.json", body: `{"names": ["a"], "nmaes": ["b"]}`, fail: true},
+		{name: "c.json", body: "names: [a]\n", fail: true},
+	}
+	for _, test := range tests {
+		filename := filepath.Join(dir, test.name)
+		if err := ioutil.WriteFile(filename, []byte(test.body), 0644); err != nil {
+			t.Fatal(err)
+		}
+		f := testFile{}
+		err := Read(filename, &f)
+		if (err != nil) != test.fail || (!test.fail && len(f.Names) != test.expect) {
+			t.Fatalf("%s: unexpected names = %v, err = %v\n", test.name, f.Names, err)
+		}
+	}
+	if err := Read(filepath.Join(dir, "nofile.yaml"), &testFile{}); err == nil {
+		t.Fatalf("expected no file error\n")
+	}
+}
@@ -1,12 +1,15 @@
 module github.com/yoshitake-hamano/gocmd
 
-go 1.14
+go 1.16
 
 require (
 	github.com/aws/aws-lambda-go v1.26.0 // indirect
 	github.com/chromedp/cdproto v0.0.0-20210808225517-c36c1bd4c35e // indirect
-	github.com/chromedp/chromedp v0.7.4 // indirect
-	github.com/go-git/go-git/v5 v5.3.0 // indirect
-	github.com/tealeg/xlsx v1.0.5 // indirect
+	github.com/chromedp/chromedp v0.7.4
+	github.com/go-git/go-git/v5 v5.3.0
+	github.com/klauspost/compress v1.11.4
+	github.com/tealeg/xlsx v1.0.5
+	github.com/ulikunitz/xz v0.5.12
 	golang.org/x/tools v0.0.0-20200823205832-c024452afbcd // indirect
+	gopkg.in/yaml.v2 v2.3.0
 )
@@ -0,0 +1,178 @@
+package scan
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+// ArchiveSeparator joins an archive path and its member path,
+// e.g. bundle.zip!lib/libfoo.a!foo.o
+const ArchiveSeparator = "!"
+
+var errNotArchive = errors.New("not archive")
+
+type memberFunc func(name string, data []byte) error
+
+const (
+	arMagic      = "!<arch>\n"
+	arHeaderSize = 60
+)
+
+func isAr(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(arMagic))
+}
+
+func isZip(data []byte) bool {
+	return bytes.HasPrefix(data, []byte("PK\x03\x04")) ||
+		bytes.HasPrefix(data, []byte("PK\x05\x06"))
+}
+
+func isTar(data []byte) bool {
+	// POSIX and GNU tar have "ustar" magic at offset 257
+	return len(data) >= 262 && string(data[257:262]) == "ustar"
+}
+
+func isArSymbolTable(name string) bool {
+	return name == "/" || name == "/SYM64/" || strings.HasPrefix(name, "__.SYMDEF")
+}
+
+// walkAr supports both GNU (long name table "//") and BSD ("#1/len") variants.
+func walkAr(data []byte, fn memberFunc) error {
+	var longNames []byte
+	p := len(arMagic)
+	for p < len(data) {
+		if p+arHeaderSize > len(data) {
+			return fmt.Errorf("ar: truncated header at %d", p)
+		}
+		hdr := data[p : p+arHeaderSize]
+		if string(hdr[58:60]) != "`\n" {
+			return fmt.Errorf("ar: invalid header at %d", p)
+		}
+		name := strings.TrimRight(string(hdr[0:16]), " ")
+		size, err := strconv.Atoi(strings.TrimSpace(string(hdr[48:58])))
+		if err != nil || size < 0 {
+			return fmt.Errorf("ar: invalid size of %q", name)
+		}
+		p += arHeaderSize
+		if size > len(data)-p {
+			return fmt.Errorf("ar: truncated member %q", name)
+		}
+		body := data[p : p+size]
+		p += size
+		if p%2 == 1 {
+			p++
+		}
+
+		switch {
+		case name == "//":
+			longNames = body
+			continue
+		case isArSymbolTable(name):
+			continue
+		case strings.HasPrefix(name, "#1/"):
+			n, err := strconv.Atoi(name[3:])
+			if err != nil || n > len(body) {
+				return fmt.Errorf("ar: invalid bsd name %q", name)
+			}
+			name = strings.TrimRight(string(body[:n]), "\x00")
+			body = body[n:]
+			if isArSymbolTable(name) {
+				continue
+			}
+		case strings.HasPrefix(name, "/"):
+			off, err := strconv.Atoi(name[1:])
+			if err != nil || off > len(longNames) {
+				return fmt.Errorf("ar: invalid long name %q", name)
+			}
+			end := bytes.Index(longNames[off:], []byte("/\n"))
+			if end < 0 {
+				end = len(longNames) - off
+			}
+			name = string(longNames[off : off+end])
+		default:
+			name = strings.TrimSuffix(name, "/")
+		}
+
+		if err := fn(name, body); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func walkZip(data []byte, limit int64, fn memberFunc) error {
+	r, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return fmt.Errorf("zip: %w", err)
+	}
+	for _, f := range r.File {
+		if !f.Mode().IsRegular() {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return fmt.Errorf("zip: %s: %w", f.Name, err)
+		}
+		body, err := readAllLimited(rc, limit)
+		rc.Close()
+		if err != nil {
+			return fmt.Errorf("zip: %s: %w", f.Name, err)
+		}
+		if err := fn(f.Name, body); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func walkTar(data []byte, fn memberFunc) error {
+	r := tar.NewReader(bytes.NewReader(data))
+	for {
+		hdr, err := r.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("tar: %w", err)
+		}
+		if !hdr.FileInfo().Mode().IsRegular() {
+			continue
+		}
+		body, err := ioutil.ReadAll(r)
+		if err != nil {
+			return fmt.Errorf("tar: %s: %w", hdr.Name, err)
+		}
+		if err := fn(hdr.Name, body); err != nil {
+			return err
+		}
+	}
+}
+
+// walkArchive calls fn for each regular member of data.
+// It returns errNotArchive if data is not a supported archive.
+// Compressed tarballs are decompressed by findCompressed beforehand.
+// Zip members are limited to limit bytes.
+func walkArchive(data []byte, limit int64, fn memberFunc) error {
+	switch {
+	case isAr(data):
+		return walkAr(data, fn)
+	case isZip(data):
+		return walkZip(data, limit, fn)
+	case isTar(data):
+		return walkTar(data, fn)
+	}
+	return errNotArchive
+}
+
+func (b *Finder) findArchive(path string, data []byte, rw ResultWriter) error {
+	return walkArchive(data, b.maxDecompressed, func(name string, member []byte) error {
+		return b.findData(path+ArchiveSeparator+name, member, rw)
+	})
+}
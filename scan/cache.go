@@ -0,0 +1,162 @@
+package scan
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+)
+
+// cacheVersion must be changed when the format of cached results changes
+const cacheVersion = "6"
+
+// Cache stores results per file content hash under dir/<hash of finder config>.
+// Results are stored per path and content hash if they depend on the path.
+// Files are always read and hashed, so that changes keeping the size and
+// modification time are not missed.
+type Cache struct {
+	dir    string
+	hits   int64
+	misses int64
+}
+
+func OpenCache(dir, configHash string) (*Cache, error) {
+	c := &Cache{dir: filepath.Join(dir, configHash)}
+	if err := os.MkdirAll(c.dir, 0755); err != nil {
+		return nil, fmt.Errorf("cache: %w", err)
+	}
+	return c, nil
+}
+
+func (c *Cache) resultsPath(hash string) string {
+	return filepath.Join(c.dir, hash[:2], hash+".json")
+}
+
+func writeFileAtomic(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// load returns cached results whose Path is relative to the scanned file
+func (c *Cache) load(hash string) ([]*Result, bool) {
+	data, err := ioutil.ReadFile(c.resultsPath(hash))
+	if err != nil {
+		return nil, false
+	}
+	results := make([]*Result, 0)
+	if err := json.Unmarshal(data, &results); err != nil {
+		return nil, false
+	}
+	return results, true
+}
+
+func (c *Cache) store(hash string, results []*Result) error {
+	data, err := json.Marshal(results)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(c.resultsPath(hash), data)
+}
+
+func (c *Cache) String() string {
+	return fmt.Sprintf("%d hits, %d misses", atomic.LoadInt64(&c.hits), atomic.LoadInt64(&c.misses))
+}
+
+func hashData(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// ConfigHash identifies everything which changes results of the same content
+func (b *Finder) ConfigHash() string {
+	h := sha256.New()
+	fmt.Fprintf(h, "version:%s\n", cacheVersion)
+	for _, rule := range b.rules {
+		fmt.Fprintf(h, "rule:%q %q %q %q %q %q %q\n", rule.ID, rule.Category, rule.Severity, rule.Pattern, rule.Exceptions, rule.Paths, rule.Contexts)
+	}
+	for _, r := range b.whitelist {
+		fmt.Fprintf(h, "white:%s\n", r)
+	}
+	fmt.Fprintf(h, "encodings:%s\n", strings.Join(b.encodings, ","))
+	fmt.Fprintf(h, "sections:%s\n", strings.Join(b.sections.include, ","))
+	fmt.Fprintf(h, "exclude-sections:%s\n", strings.Join(b.sections.exclude, ","))
+	fmt.Fprintf(h, "source:%t\n", b.source)
+	fmt.Fprintf(h, "dump:%t\n", b.dump)
+	fmt.Fprintf(h, "filter:%d %g\n", b.filter.minLength, b.filter.minTextRatio)
+	fmt.Fprintf(h, "max-decompressed:%d\n", b.maxDecompressed)
+	fmt.Fprintf(h, "root:%s\n", b.root)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (b *Finder) SetCache(c *Cache) {
+	b.cache = c
+}
+
+// pathDependent reports whether results of the same content depend on the path,
+// by rules with paths or by source files detected by the extension
+func (b *Finder) pathDependent() bool {
+	if b.source {
+		return true
+	}
+	for _, rule := range b.rules {
+		if len(rule.Paths) != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// findCached replays cached results of unchanged content, otherwise scans and caches it
+func (b *Finder) findCached(path string, rw ResultWriter) error {
+	c := b.cache
+	data, err := b.readFile(path)
+	if err != nil {
+		return err
+	}
+	hash := hashData(data)
+
+	key := hash
+	if b.pathDependent() {
+		key = hashData([]byte(path + "\x00" + hash))
+	}
+	if results, ok := c.load(key); ok {
+		atomic.AddInt64(&c.hits, 1)
+		for _, r := range results {
+			r.Path = path + r.Path
+			rw.Write(r)
+		}
+		return nil
+	}
+	atomic.AddInt64(&c.misses, 1)
+
+	collector := &ResultCollector{}
+	if err := b.findData(path, data, MultiResultWriter{rw, collector}); err != nil {
+		return err
+	}
+	cached := make([]*Result, 0, len(collector.Results))
+	for _, r := range collector.Results {
+		relative := *r
+		relative.Path = strings.TrimPrefix(r.Path, path)
+		cached = append(cached, &relative)
+	}
+	return c.store(key, cached)
+}
@@ -0,0 +1,168 @@
+package scan
+
+import (
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"compress/zlib"
+	"debug/elf"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// compressions of payloads, which are also file types of standalone compressed files
+const (
+	CompressionGzip  = "gzip"
+	CompressionBzip2 = "bzip2"
+	CompressionXz    = "xz"
+	CompressionZstd  = "zstd"
+	CompressionZlib  = "zlib"
+)
+
+// DefaultMaxDecompressedSize is the default limit of each decompressed payload and zip member,
+// which protects from decompression bombs
+const DefaultMaxDecompressedSize int64 = 256 << 20
+
+// DetectCompression returns the compression of standalone data by magic number, or "" if not compressed
+func DetectCompression(data []byte) string {
+	switch {
+	case bytes.HasPrefix(data, []byte{0x1f, 0x8b}):
+		return CompressionGzip
+	case bytes.HasPrefix(data, []byte("BZh")) && len(data) > 3 && '1' <= data[3] && data[3] <= '9':
+		return CompressionBzip2
+	case bytes.HasPrefix(data, []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}):
+		return CompressionXz
+	case bytes.HasPrefix(data, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		return CompressionZstd
+	}
+	return ""
+}
+
+// errTooLarge is returned if decompressed data exceeds the limit,
+// which is an error of the file rather than data which is not compressed
+var errTooLarge = errors.New("decompressed size exceeds the limit")
+
+func readAllLimited(r io.Reader, limit int64) ([]byte, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > limit {
+		return nil, fmt.Errorf("%w of %d bytes", errTooLarge, limit)
+	}
+	return data, nil
+}
+
+// SetMaxDecompressedSize limits each decompressed payload, compressed ELF section and zip member to n bytes
+func (b *Finder) SetMaxDecompressedSize(n int64) {
+	b.maxDecompressed = n
+}
+
+// DecompressReader returns the reader of the decompressed r, which must be closed
+func DecompressReader(compression string, r io.Reader) (io.ReadCloser, error) {
+	switch compression {
+	case CompressionGzip:
+		return gzip.NewReader(r)
+	case CompressionBzip2:
+		return ioutil.NopCloser(bzip2.NewReader(r)), nil
+	case CompressionXz:
+		xr, err := xz.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.NopCloser(xr), nil
+	case CompressionZstd:
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return zr.IOReadCloser(), nil
+	case CompressionZlib:
+		return zlib.NewReader(r)
+	}
+	return nil, fmt.Errorf("unknown compression: %s", compression)
+}
+
+func decompress(compression string, data []byte, limit int64) ([]byte, error) {
+	r, err := DecompressReader(compression, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return readAllLimited(r, limit)
+}
+
+// compressionResultWriter records the compression layer, e.g. "gzip/zlib"
+// for a compressed ELF section in a gzip file.
+type compressionResultWriter struct {
+	rw          ResultWriter
+	compression string
+}
+
+func (cw *compressionResultWriter) Write(r *Result) {
+	if r.Compression == "" {
+		r.Compression = cw.compression
+	} else {
+		r.Compression = cw.compression + "/" + r.Compression
+	}
+	cw.rw.Write(r)
+}
+
+func (cw *compressionResultWriter) Flush() error {
+	return cw.rw.Flush()
+}
+
+// findCompressed scans the decompressed data of a standalone compressed file.
+// It returns errNotArchive if data is not compressed, and errTooLarge if it exceeds the limit.
+func (b *Finder) findCompressed(path string, data []byte, rw ResultWriter) error {
+	compression := DetectCompression(data)
+	if compression == "" {
+		return errNotArchive
+	}
+	decompressed, err := decompress(compression, data, b.maxDecompressed)
+	if errors.Is(err, errTooLarge) {
+		return err
+	}
+	if err != nil {
+		// data like a bzip2 magic in a text file is not compressed actually
+		return errNotArchive
+	}
+	return b.findData(path, decompressed, &compressionResultWriter{rw: rw, compression: compression})
+}
+
+// elfCompressZstd is ELFCOMPRESS_ZSTD, which debug/elf does not define before Go 1.21
+const elfCompressZstd = 2
+
+// elfSectionData returns the decompressed data of the section and its compression.
+// debug/elf decompresses both SHF_COMPRESSED sections and GNU style .zdebug_* sections,
+// and the decompressed data is limited to limit bytes.
+// data is the whole ELF file.
+func elfSectionData(f *elf.File, data []byte, section *elf.Section, limit int64) ([]byte, string, error) {
+	compression := ""
+	raw := data[:0]
+	if section.Offset < uint64(len(data)) {
+		raw = data[section.Offset:]
+	}
+	switch {
+	case section.Flags&elf.SHF_COMPRESSED != 0:
+		// ch_type is the first word of the compression header
+		compression = CompressionZlib
+		if len(raw) >= 4 && f.ByteOrder.Uint32(raw) == elfCompressZstd {
+			compression = CompressionZstd
+		}
+	case strings.HasPrefix(section.Name, ".zdebug") && bytes.HasPrefix(raw, []byte("ZLIB")):
+		compression = CompressionZlib
+	}
+	if compression == "" {
+		src, err := section.Data()
+		return src, compression, err
+	}
+	src, err := readAllLimited(section.Open(), limit)
+	return src, compression, err
+}
@@ -0,0 +1,45 @@
+package scan
+
+import (
+	"unicode/utf16"
+)
+
+const (
+	dumpBefore = 32
+	dumpAfter  = 64
+	// DumpLineSize is the alignment of Result.Dump
+	DumpLineSize = 16
+)
+
+func (b *Finder) SetDump(dump bool) {
+	b.dump = dump
+}
+
+// dumpAround returns a copy of data around offset aligned to DumpLineSize,
+// and the file offset of the first byte. fileOffset is the file offset of data[offset].
+func dumpAround(data []byte, offset int, fileOffset int64) ([]byte, int64) {
+	if offset < 0 || offset > len(data) {
+		return nil, 0
+	}
+	start := offset - dumpBefore
+	start -= ((start % DumpLineSize) + DumpLineSize) % DumpLineSize
+	if start < 0 {
+		start = 0
+	}
+	end := offset + dumpAfter
+	if end > len(data) {
+		end = len(data)
+	}
+	dump := make([]byte, end-start)
+	copy(dump, data[start:end])
+	return dump, fileOffset - int64(offset-start)
+}
+
+// ByteLength returns the length of the token in the scanned data
+func (r *Result) ByteLength() int {
+	switch r.Encoding {
+	case EncodingUTF16LE, EncodingUTF16BE:
+		return 2 * len(utf16.Encode([]rune(r.Text)))
+	}
+	return len(r.Text)
+}
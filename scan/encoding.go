@@ -0,0 +1,164 @@
+package scan
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+const (
+	EncodingASCII   = "ascii"
+	EncodingUTF8    = "utf8"
+	EncodingUTF16LE = "utf16le"
+	EncodingUTF16BE = "utf16be"
+	EncodingAll     = "all"
+)
+
+// tokenFunc receives a decoded token, its byte offset in data and its encoding
+type tokenFunc func(offset int, token, encoding string)
+
+type tokenizer func(data []byte, fn tokenFunc)
+
+var tokenizers = map[string]tokenizer{
+	EncodingASCII:   tokenizeASCII,
+	EncodingUTF8:    tokenizeUTF8,
+	EncodingUTF16LE: tokenizeUTF16(binary.LittleEndian, EncodingUTF16LE),
+	EncodingUTF16BE: tokenizeUTF16(binary.BigEndian, EncodingUTF16BE),
+}
+
+// ParseEncodings parses comma separated encodings such as "ascii,utf16le".
+// utf8 is a superset of ascii, so ascii is dropped when both are given.
+func ParseEncodings(s string) ([]string, error) {
+	selected := make(map[string]bool)
+	for _, e := range strings.Split(s, ",") {
+		e = strings.ToLower(strings.TrimSpace(e))
+		switch {
+		case e == EncodingAll:
+			selected[EncodingUTF8] = true
+			selected[EncodingUTF16LE] = true
+			selected[EncodingUTF16BE] = true
+		case tokenizers[e] != nil:
+			selected[e] = true
+		default:
+			return nil, fmt.Errorf("unknown encoding: %q", e)
+		}
+	}
+	if selected[EncodingUTF8] {
+		delete(selected, EncodingASCII)
+	}
+
+	encodings := make([]string, 0, len(selected))
+	for _, e := range []string{EncodingASCII, EncodingUTF8, EncodingUTF16LE, EncodingUTF16BE} {
+		if selected[e] {
+			encodings = append(encodings, e)
+		}
+	}
+	return encodings, nil
+}
+
+func isTokenable(b byte) bool {
+	// see ascii table
+	if 0x20 <= b && b <= 0x7e {
+		return true
+	}
+	return b == '\t'
+}
+
+func isTokenableRune(r rune) bool {
+	return r == '\t' || unicode.IsPrint(r)
+}
+
+func tokenizeASCII(data []byte, fn tokenFunc) {
+	start := -1
+	for i, b := range data {
+		if isTokenable(b) {
+			if start < 0 {
+				start = i
+			}
+			continue
+		}
+		if start >= 0 {
+			fn(start, string(data[start:i]), EncodingASCII)
+			start = -1
+		}
+	}
+	if start >= 0 {
+		fn(start, string(data[start:]), EncodingASCII)
+	}
+}
+
+// tokenizeUTF8 reports tokens which consist only of ascii as "ascii".
+func tokenizeUTF8(data []byte, fn tokenFunc) {
+	start := -1
+	multibyte := false
+	emit := func(end int) {
+		if start < 0 {
+			return
+		}
+		encoding := EncodingASCII
+		if multibyte {
+			encoding = EncodingUTF8
+		}
+		fn(start, string(data[start:end]), encoding)
+		start = -1
+		multibyte = false
+	}
+
+	for i := 0; i < len(data); {
+		r, size := utf8.DecodeRune(data[i:])
+		if (r == utf8.RuneError && size == 1) || !isTokenableRune(r) {
+			emit(i)
+			i += size
+			continue
+		}
+		if start < 0 {
+			start = i
+		}
+		if size > 1 {
+			multibyte = true
+		}
+		i += size
+	}
+	emit(len(data))
+}
+
+// tokenizeUTF16 assumes that strings are aligned to 2 bytes.
+func tokenizeUTF16(order binary.ByteOrder, encoding string) tokenizer {
+	return func(data []byte, fn tokenFunc) {
+		start := -1
+		runes := make([]rune, 0)
+		emit := func() {
+			if start >= 0 {
+				fn(start, string(runes), encoding)
+			}
+			start = -1
+			runes = runes[:0]
+		}
+
+		for i := 0; i+1 < len(data); {
+			r := rune(order.Uint16(data[i:]))
+			size := 2
+			if utf16.IsSurrogate(r) {
+				r = unicode.ReplacementChar
+				if i+3 < len(data) {
+					r = utf16.DecodeRune(r, rune(order.Uint16(data[i+2:])))
+					size = 4
+				}
+			}
+			if r == unicode.ReplacementChar || !isTokenableRune(r) {
+				emit()
+				i += 2
+				continue
+			}
+			if start < 0 {
+				start = i
+			}
+			runes = append(runes, r)
+			i += size
+		}
+		emit()
+	}
+}
@@ -0,0 +1,147 @@
+package scan
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// file types detected by magic numbers.
+// Compressed tarballs are detected as "tar",
+// and the other compressed files as their compression such as "gzip".
+const (
+	FileTypeELF   = "elf"
+	FileTypePE    = "pe"
+	FileTypeMacho = "macho"
+	FileTypeAr    = "ar"
+	FileTypeZip   = "zip"
+	FileTypeTar   = "tar"
+	FileTypeBin   = "bin"
+)
+
+// MagicSize is the number of leading bytes which DetectFileType needs
+const MagicSize = 512
+
+// fileTypeGroups are aliases of several file types
+var fileTypeGroups = map[string][]string{
+	"archive":    {FileTypeAr, FileTypeZip, FileTypeTar},
+	"compressed": {CompressionGzip, CompressionBzip2, CompressionXz, CompressionZstd},
+}
+
+var fileTypes = []string{
+	FileTypeELF, FileTypePE, FileTypeMacho, FileTypeAr, FileTypeZip, FileTypeTar,
+	CompressionGzip, CompressionBzip2, CompressionXz, CompressionZstd, FileTypeBin,
+}
+
+func isMacho(data []byte) bool {
+	for _, magic := range [][]byte{
+		{0xfe, 0xed, 0xfa, 0xce}, {0xfe, 0xed, 0xfa, 0xcf},
+		{0xce, 0xfa, 0xed, 0xfe}, {0xcf, 0xfa, 0xed, 0xfe},
+		{0xca, 0xfe, 0xba, 0xbe},
+	} {
+		if bytes.HasPrefix(data, magic) {
+			return true
+		}
+	}
+	return false
+}
+
+// isPE checks the PE signature at e_lfanew after the MZ header
+func isPE(data []byte) bool {
+	if !bytes.HasPrefix(data, []byte("MZ")) || len(data) < 0x40 {
+		return false
+	}
+	lfanew := int64(binary.LittleEndian.Uint32(data[0x3c:]))
+	return lfanew+4 <= int64(len(data)) && string(data[lfanew:lfanew+4]) == "PE\x00\x00"
+}
+
+// isCompressedTar decompresses the head of data, which may be truncated, and checks the tar magic
+func isCompressedTar(compression string, data []byte) bool {
+	r, err := DecompressReader(compression, bytes.NewReader(data))
+	if err != nil {
+		return false
+	}
+	defer r.Close()
+	head := make([]byte, 512)
+	n, _ := io.ReadFull(r, head)
+	return isTar(head[:n])
+}
+
+// DetectFileType returns the file type of data like file(1), or "bin" if unknown.
+// data needs MagicSize bytes at most, so PE files whose signature is beyond them are "bin",
+// and compressed tarballs are detected only if the head of data decompresses, such as gzip.
+func DetectFileType(data []byte) string {
+	switch {
+	case bytes.HasPrefix(data, []byte(elf.ELFMAG)):
+		return FileTypeELF
+	case isPE(data):
+		return FileTypePE
+	case isMacho(data):
+		return FileTypeMacho
+	case isAr(data):
+		return FileTypeAr
+	case isZip(data):
+		return FileTypeZip
+	case isTar(data):
+		return FileTypeTar
+	}
+	if compression := DetectCompression(data); compression != "" {
+		if isCompressedTar(compression, data) {
+			return FileTypeTar
+		}
+		return compression
+	}
+	return FileTypeBin
+}
+
+// FileTypeFilter selects files by DetectFileType
+type FileTypeFilter struct {
+	include map[string]bool
+	exclude map[string]bool
+}
+
+func parseFileTypes(s string) (map[string]bool, error) {
+	types := make(map[string]bool)
+	for _, t := range splitPatterns(s) {
+		if group, ok := fileTypeGroups[t]; ok {
+			for _, g := range group {
+				types[g] = true
+			}
+			continue
+		}
+		if !containsString(fileTypes, t) {
+			return nil, fmt.Errorf("unknown file type %q", t)
+		}
+		types[t] = true
+	}
+	return types, nil
+}
+
+// ParseFileTypeFilter parses comma separated file types.
+// "archive" and "compressed" select all archive and compression types.
+// Empty include selects all file types.
+func ParseFileTypeFilter(include, exclude string) (*FileTypeFilter, error) {
+	var err error
+	tf := &FileTypeFilter{}
+	if tf.include, err = parseFileTypes(include); err != nil {
+		return nil, err
+	}
+	if tf.exclude, err = parseFileTypes(exclude); err != nil {
+		return nil, err
+	}
+	return tf, nil
+}
+
+// All reports whether the filter selects all file types, so that files need not be read
+func (tf *FileTypeFilter) All() bool {
+	return len(tf.include) == 0 && len(tf.exclude) == 0
+}
+
+func (tf *FileTypeFilter) Match(fileType string) bool {
+	if len(tf.include) != 0 && !tf.include[fileType] {
+		return false
+	}
+	return !tf.exclude[fileType]
+}
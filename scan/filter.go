@@ -0,0 +1,56 @@
+package scan
+
+import (
+	"sync/atomic"
+	"unicode"
+	"unicode/utf8"
+)
+
+// tokenFilter drops noisy tokens of binaries before matching.
+// Raw binaries contain many short printable fragments which hit short regexps.
+type tokenFilter struct {
+	// minLength is the minimum number of characters like strings -n
+	minLength int
+	// minTextRatio is the minimum ratio of letters, digits and spaces, or 0 not to filter
+	minTextRatio float64
+}
+
+func (tf tokenFilter) pass(t string) bool {
+	if tf.minLength > 1 && utf8.RuneCountInString(t) < tf.minLength {
+		return false
+	}
+	if tf.minTextRatio > 0 && textRatio(t) < tf.minTextRatio {
+		return false
+	}
+	return true
+}
+
+// textRatio returns the ratio of letters, digits and spaces in t.
+// Text is usually above 0.8 at any length, while printable fragments of random data
+// are about 0.65 as 62 of 95 printable ASCII characters are letters and digits.
+func textRatio(t string) float64 {
+	text, n := 0, 0
+	for _, r := range t {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || r == ' ' {
+			text++
+		}
+		n++
+	}
+	if n == 0 {
+		return 0
+	}
+	return float64(text) / float64(n)
+}
+
+// SetTokenFilter drops tokens of binaries shorter than minLength characters,
+// or whose ratio of letters, digits and spaces is lower than minTextRatio.
+// 0 disables each filter. Source files are not filtered.
+func (b *Finder) SetTokenFilter(minLength int, minTextRatio float64) {
+	b.filter = tokenFilter{minLength: minLength, minTextRatio: minTextRatio}
+}
+
+// Filtered returns the number of tokens dropped by the token filter.
+// Tokens of files replayed from the cache are not counted.
+func (b *Finder) Filtered() int64 {
+	return atomic.LoadInt64(&b.nFiltered)
+}
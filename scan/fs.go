@@ -0,0 +1,85 @@
+package scan
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"sync/atomic"
+)
+
+// Finding is a result sent by Scan.
+// If Err is not nil, Path could not be scanned and the other fields are empty.
+type Finding struct {
+	Result
+	Err error
+}
+
+// findingWriter sends results to a channel until ctx is canceled
+type findingWriter struct {
+	ctx context.Context
+	ch  chan<- Finding
+}
+
+func (fw *findingWriter) send(f Finding) bool {
+	select {
+	case fw.ch <- f:
+		return true
+	case <-fw.ctx.Done():
+		return false
+	}
+}
+
+func (fw *findingWriter) Write(r *Result) {
+	fw.send(Finding{Result: *r})
+}
+
+func (fw *findingWriter) Flush() error {
+	return nil
+}
+
+// Scan scans all regular files in fsys with rules and the default encodings and sections.
+// Use Finder.Scan to change them.
+func Scan(ctx context.Context, fsys fs.FS, rules []*Rule) <-chan Finding {
+	b := NewFinder(nil, nil)
+	b.AddRules(rules)
+	return b.Scan(ctx, fsys)
+}
+
+// Scan scans all regular files in fsys, and sends the findings to the returned channel.
+// Paths of findings are the slash-separated paths in fsys.
+// The channel is closed when all files are scanned or ctx is canceled.
+// The cache is not used.
+func (b *Finder) Scan(ctx context.Context, fsys fs.FS) <-chan Finding {
+	ch := make(chan Finding)
+	fw := &findingWriter{ctx: ctx, ch: ch}
+	go func() {
+		defer close(ch)
+		fs.WalkDir(fsys, ".", func(path string, d fs.DirEntry, err error) error {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if err == nil && !d.Type().IsRegular() {
+				return nil
+			}
+			if err == nil {
+				var info fs.FileInfo
+				if info, err = d.Info(); err == nil {
+					err = b.checkFileSize(info.Size())
+				}
+			}
+			if err == nil {
+				var data []byte
+				data, err = fs.ReadFile(fsys, path)
+				if err == nil {
+					atomic.AddInt64(&b.nFiles, 1)
+					err = b.findData(path, data, fw)
+				}
+			}
+			if err != nil {
+				fw.send(Finding{Result: Result{Path: path}, Err: fmt.Errorf("%s: %w", path, err)})
+			}
+			return nil
+		})
+	}()
+	return ch
+}
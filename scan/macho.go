@@ -0,0 +1,101 @@
+package scan
+
+import (
+	"bytes"
+	"debug/macho"
+)
+
+const (
+	machoSectionTypeMask     = 0xff
+	machoZerofill            = 0x1
+	machoGBZerofill          = 0xc
+	machoThreadLocalZerofill = 0x12
+	machoDwarfSegment        = "__DWARF"
+)
+
+func isMachoZerofill(s *macho.Section) bool {
+	switch s.Flags & machoSectionTypeMask {
+	case machoZerofill, machoGBZerofill, machoThreadLocalZerofill:
+		return true
+	}
+	return false
+}
+
+// machoSymbols returns symbols per section number, whose values are virtual addresses
+func machoSymbols(f *macho.File) map[int]nearestSymbols {
+	symbols := make(map[int][]symbol)
+	if f.Symtab == nil {
+		return nil
+	}
+	for _, sym := range f.Symtab.Syms {
+		if sym.Sect == 0 || sym.Name == "" {
+			continue
+		}
+		n := int(sym.Sect)
+		symbols[n] = append(symbols[n], symbol{name: sym.Name, value: sym.Value})
+	}
+	ns := make(map[int]nearestSymbols)
+	for n, syms := range symbols {
+		ns[n] = newNearestSymbols(syms)
+	}
+	return ns
+}
+
+func (b *Finder) findMachoFile(path string, f *macho.File, rw ResultWriter) error {
+	symbols := machoSymbols(f)
+	for i, section := range f.Sections {
+		if section.Size == 0 || isMachoZerofill(section) {
+			continue
+		}
+		// section name is shown like lldb, e.g. "__TEXT.__cstring"
+		name := section.Seg + "." + section.Name
+		loadable := section.Seg != machoDwarfSegment
+		if !b.sections.match(name, loadable) && !b.sections.match(section.Name, loadable) {
+			continue
+		}
+
+		src, err := section.Data()
+		if err != nil {
+			return err
+		}
+		// section number is 1-based
+		syms := symbols[i+1]
+		addr := section.Addr
+		reg := &region{
+			path:     path,
+			filetype: "macho",
+			section:  name,
+			offset:   int64(section.Offset),
+			address:  addr,
+			symbolize: func(offset int64) string {
+				return syms.lookup(addr + uint64(offset))
+			},
+		}
+		err = b.findBinary(reg, src, rw)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// findMacho supports fat binaries, whose architectures are reported like members of archives
+func (b *Finder) findMacho(path string, data []byte, rw ResultWriter) error {
+	if ff, err := macho.NewFatFile(bytes.NewReader(data)); err == nil {
+		defer ff.Close()
+		for _, arch := range ff.Arches {
+			err := b.findMachoFile(path+ArchiveSeparator+arch.Cpu.String(), arch.File, rw)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	f, err := macho.NewFile(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return b.findMachoFile(path, f, rw)
+}
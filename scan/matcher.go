@@ -0,0 +1,267 @@
+package scan
+
+import (
+	"regexp"
+	"regexp/syntax"
+	"sort"
+	"strings"
+)
+
+// ahoCorasick finds all patterns contained in a text in one pass.
+// If fold is true, patterns and texts are compared ignoring ascii case.
+type ahoCorasick struct {
+	fold  bool
+	nodes []acNode
+}
+
+type acNode struct {
+	next map[byte]int32
+	fail int32
+	// out is the list of ids of patterns which end at the node
+	out []int
+}
+
+func toLowerASCII(c byte) byte {
+	if 'A' <= c && c <= 'Z' {
+		return c + 'a' - 'A'
+	}
+	return c
+}
+
+func newAhoCorasick(patterns []string, ids []int, fold bool) *ahoCorasick {
+	ac := &ahoCorasick{
+		fold:  fold,
+		nodes: []acNode{{next: make(map[byte]int32)}},
+	}
+	for i, p := range patterns {
+		n := int32(0)
+		for j := 0; j < len(p); j++ {
+			c := p[j]
+			if fold {
+				c = toLowerASCII(c)
+			}
+			next, ok := ac.nodes[n].next[c]
+			if !ok {
+				next = int32(len(ac.nodes))
+				ac.nodes = append(ac.nodes, acNode{next: make(map[byte]int32)})
+				ac.nodes[n].next[c] = next
+			}
+			n = next
+		}
+		ac.nodes[n].out = append(ac.nodes[n].out, ids[i])
+	}
+
+	// build failure links by breadth first search
+	queue := make([]int32, 0, len(ac.nodes))
+	for _, child := range ac.nodes[0].next {
+		queue = append(queue, child)
+	}
+	for len(queue) != 0 {
+		n := queue[0]
+		queue = queue[1:]
+		for c, child := range ac.nodes[n].next {
+			f := ac.nodes[n].fail
+			for {
+				if next, ok := ac.nodes[f].next[c]; ok && next != child {
+					ac.nodes[child].fail = next
+					break
+				}
+				if f == 0 {
+					break
+				}
+				f = ac.nodes[f].fail
+			}
+			fail := ac.nodes[child].fail
+			ac.nodes[child].out = append(ac.nodes[child].out, ac.nodes[fail].out...)
+			queue = append(queue, child)
+		}
+	}
+	return ac
+}
+
+// find calls fn with the id of every pattern which occurs in text
+func (ac *ahoCorasick) find(text string, fn func(id int)) {
+	n := int32(0)
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		if ac.fold {
+			c = toLowerASCII(c)
+		}
+		for {
+			if next, ok := ac.nodes[n].next[c]; ok {
+				n = next
+				break
+			}
+			if n == 0 {
+				break
+			}
+			n = ac.nodes[n].fail
+		}
+		for _, id := range ac.nodes[n].out {
+			fn(id)
+		}
+	}
+}
+
+// literalOf returns the literal if r matches exactly the strings containing it
+func literalOf(r *regexp.Regexp) (literal string, fold bool, ok bool) {
+	re, err := syntax.Parse(r.String(), syntax.Perl)
+	if err != nil {
+		return "", false, false
+	}
+	re = re.Simplify()
+	if re.Op != syntax.OpLiteral || len(re.Rune) == 0 {
+		return "", false, false
+	}
+	return string(re.Rune), re.Flags&syntax.FoldCase != 0, true
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
+
+// multiMatcher matches many regexps at once.
+// Literals are matched by Aho-Corasick automatons. The other regexps are
+// prefiltered by their literal prefixes, or by combined regexps.
+type multiMatcher struct {
+	regexps []*regexp.Regexp
+	literal *ahoCorasick
+	// fold matches case insensitive ascii literals, which also match some
+	// non ascii runes like U+212A(Kelvin sign), so non ascii texts use foldRegexps.
+	fold        *ahoCorasick
+	foldRegexps []int
+	// prefix finds regexps whose literal prefix is contained in a text
+	prefix *ahoCorasick
+	others []combinedRegexp
+}
+
+// combinedRegexp is the alternation of regexps, which matches if any of them matches
+type combinedRegexp struct {
+	ids      []int
+	combined *regexp.Regexp
+}
+
+// maxCombinedRegexps limits the size of one combined regexp
+const maxCombinedRegexps = 64
+
+func newMultiMatcher(regexps []*regexp.Regexp) *multiMatcher {
+	m := &multiMatcher{regexps: regexps}
+	literals, literalIDs := make([]string, 0), make([]int, 0)
+	folds, foldIDs := make([]string, 0), make([]int, 0)
+	prefixes, prefixIDs := make([]string, 0), make([]int, 0)
+	others := make([]int, 0)
+	for i, r := range regexps {
+		literal, fold, ok := literalOf(r)
+		prefix, _ := r.LiteralPrefix()
+		switch {
+		case ok && !fold:
+			literals = append(literals, literal)
+			literalIDs = append(literalIDs, i)
+		case ok && fold && isASCII(literal):
+			folds = append(folds, literal)
+			foldIDs = append(foldIDs, i)
+			m.foldRegexps = append(m.foldRegexps, i)
+		case prefix != "":
+			prefixes = append(prefixes, prefix)
+			prefixIDs = append(prefixIDs, i)
+		default:
+			others = append(others, i)
+		}
+	}
+	m.literal = newAhoCorasick(literals, literalIDs, false)
+	m.fold = newAhoCorasick(folds, foldIDs, true)
+	m.prefix = newAhoCorasick(prefixes, prefixIDs, false)
+
+	for len(others) != 0 {
+		n := len(others)
+		if n > maxCombinedRegexps {
+			n = maxCombinedRegexps
+		}
+		c := combinedRegexp{ids: others[:n]}
+		alternatives := make([]string, 0, n)
+		for _, i := range c.ids {
+			alternatives = append(alternatives, "(?:"+regexps[i].String()+")")
+		}
+		// the combined regexp is only a prefilter, so it is not used if it fails to compile
+		c.combined, _ = regexp.Compile(strings.Join(alternatives, "|"))
+		m.others = append(m.others, c)
+		others = others[n:]
+	}
+	return m
+}
+
+func (m *multiMatcher) find(text string, fn func(id int)) {
+	m.literal.find(text, fn)
+	if isASCII(text) {
+		m.fold.find(text, fn)
+	} else {
+		for _, i := range m.foldRegexps {
+			if m.regexps[i].MatchString(text) {
+				fn(i)
+			}
+		}
+	}
+	// a regexp may have the same prefix more than once in a text
+	var checked map[int]bool
+	m.prefix.find(text, func(id int) {
+		if checked == nil {
+			checked = make(map[int]bool)
+		}
+		if !checked[id] {
+			checked[id] = true
+			if m.regexps[id].MatchString(text) {
+				fn(id)
+			}
+		}
+	})
+	for _, c := range m.others {
+		if c.combined != nil && !c.combined.MatchString(text) {
+			continue
+		}
+		for _, i := range c.ids {
+			if m.regexps[i].MatchString(text) {
+				fn(i)
+			}
+		}
+	}
+}
+
+func (m *multiMatcher) matchAny(text string) bool {
+	found := false
+	m.find(text, func(id int) {
+		found = true
+	})
+	return found
+}
+
+// matchIDs returns the indexes of matched regexps in ascending order
+func (m *multiMatcher) matchIDs(text string) []int {
+	ids := make([]int, 0)
+	seen := make(map[int]bool)
+	m.find(text, func(id int) {
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	})
+	sort.Ints(ids)
+	return ids
+}
+
+// matchAll returns the matched regexps in the original order
+func (m *multiMatcher) matchAll(text string) []*regexp.Regexp {
+	ids := m.matchIDs(text)
+	if len(ids) == 0 {
+		return nil
+	}
+	matched := make([]*regexp.Regexp, 0, len(ids))
+	for _, id := range ids {
+		matched = append(matched, m.regexps[id])
+	}
+	return matched
+}
@@ -0,0 +1,106 @@
+package scan
+
+import (
+	"bytes"
+	"debug/pe"
+	"fmt"
+	"strings"
+)
+
+const (
+	peScnCntCode            = 0x00000020
+	peScnCntInitializedData = 0x00000040
+	peScnMemDiscardable     = 0x02000000
+	peSymClassExternal      = 2
+	peSymClassStatic        = 3
+)
+
+func peImageBase(f *pe.File) uint64 {
+	switch oh := f.OptionalHeader.(type) {
+	case *pe.OptionalHeader32:
+		return uint64(oh.ImageBase)
+	case *pe.OptionalHeader64:
+		return oh.ImageBase
+	}
+	return 0
+}
+
+// peSymbols returns COFF symbols per section number, whose values are section relative
+func peSymbols(f *pe.File) map[int]nearestSymbols {
+	symbols := make(map[int][]symbol)
+	for _, sym := range f.Symbols {
+		if sym.StorageClass != peSymClassExternal && sym.StorageClass != peSymClassStatic {
+			continue
+		}
+		if sym.SectionNumber <= 0 || strings.HasPrefix(sym.Name, ".") {
+			continue
+		}
+		n := int(sym.SectionNumber)
+		symbols[n] = append(symbols[n], symbol{name: sym.Name, value: uint64(sym.Value)})
+	}
+	ns := make(map[int]nearestSymbols)
+	for n, syms := range symbols {
+		ns[n] = newNearestSymbols(syms)
+	}
+	return ns
+}
+
+// coffMachines are the machines of COFF objects without the MZ header.
+// debug/pe parses any other data as a COFF object, e.g. zeros as an object without sections.
+var coffMachines = map[uint16]bool{
+	pe.IMAGE_FILE_MACHINE_I386:  true,
+	pe.IMAGE_FILE_MACHINE_AMD64: true,
+	pe.IMAGE_FILE_MACHINE_ARM:   true,
+	pe.IMAGE_FILE_MACHINE_ARMNT: true,
+	pe.IMAGE_FILE_MACHINE_ARM64: true,
+}
+
+func (b *Finder) findPE(path string, data []byte, rw ResultWriter) error {
+	f, err := pe.NewFile(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if !bytes.HasPrefix(data, []byte("MZ")) && !coffMachines[f.Machine] {
+		return fmt.Errorf("unknown COFF machine 0x%x", f.Machine)
+	}
+
+	imageBase := peImageBase(f)
+	symbols := peSymbols(f)
+	for i, section := range f.Sections {
+		if section.Size == 0 {
+			continue
+		}
+		c := section.Characteristics
+		loadable := (c&(peScnCntCode|peScnCntInitializedData)) != 0 && (c&peScnMemDiscardable) == 0
+		if !b.sections.match(section.Name, loadable) {
+			continue
+		}
+
+		src, err := section.Data()
+		if err != nil {
+			return err
+		}
+		// section number is 1-based
+		syms := symbols[i+1]
+		var address uint64
+		if imageBase != 0 {
+			address = imageBase + uint64(section.VirtualAddress)
+		}
+		reg := &region{
+			path:     path,
+			filetype: "pe",
+			section:  section.Name,
+			offset:   int64(section.Offset),
+			address:  address,
+			symbolize: func(offset int64) string {
+				return syms.lookup(uint64(offset))
+			},
+		}
+		err = b.findBinary(reg, src, rw)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,210 @@
+package scan
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/yoshitake-hamano/gocmd/config"
+)
+
+// Severities in ascending order
+var Severities = []string{"info", "low", "medium", "high", "critical"}
+
+// SeverityRank returns the index in Severities, or -1 if unknown
+func SeverityRank(severity string) int {
+	for i, s := range Severities {
+		if s == severity {
+			return i
+		}
+	}
+	return -1
+}
+
+// Rule is a blacklist regexp with metadata.
+//
+//   rules:
+//     - id: customer-acme
+//       category: customer name
+//       severity: high
+//       pattern: "(?i)acme"
+//       exceptions: ["(?i)acme-open-source"]
+//       paths: ["firmware/**"]
+//       contexts: [string, comment]
+//
+// paths are relative to the root of the Finder, such as the input directory.
+// contexts restricts the rule in source files, and is ignored in binaries.
+type Rule struct {
+	ID         string   `yaml:"id" json:"id"`
+	Category   string   `yaml:"category" json:"category"`
+	Severity   string   `yaml:"severity" json:"severity"`
+	Pattern    string   `yaml:"pattern" json:"pattern"`
+	Exceptions []string `yaml:"exceptions" json:"exceptions"`
+	Paths      []string `yaml:"paths" json:"paths"`
+	Contexts   []string `yaml:"contexts" json:"contexts"`
+
+	pattern    *regexp.Regexp
+	exceptions []*regexp.Regexp
+	paths      []*regexp.Regexp
+}
+
+type ruleFile struct {
+	Rules []*Rule `yaml:"rules" json:"rules"`
+}
+
+// newBlacklistRule returns the rule of a -black regexp, which has no metadata
+func newBlacklistRule(r *regexp.Regexp) *Rule {
+	return &Rule{Pattern: r.String(), pattern: r}
+}
+
+func (rule *Rule) compile() error {
+	if rule.ID == "" || rule.Severity == "" || rule.Pattern == "" {
+		return fmt.Errorf("id, severity and pattern are required")
+	}
+	if SeverityRank(rule.Severity) < 0 {
+		return fmt.Errorf("severity: unknown %q(%s)", rule.Severity, strings.Join(Severities, ", "))
+	}
+	var err error
+	rule.pattern, err = regexp.Compile(rule.Pattern)
+	if err != nil {
+		return fmt.Errorf("pattern: %w", err)
+	}
+	for _, e := range rule.Exceptions {
+		r, err := regexp.Compile(e)
+		if err != nil {
+			return fmt.Errorf("exceptions: %w", err)
+		}
+		rule.exceptions = append(rule.exceptions, r)
+	}
+	for _, c := range rule.Contexts {
+		if !containsString(contexts, c) {
+			return fmt.Errorf("contexts: unknown %q(%s)", c, strings.Join(contexts, ", "))
+		}
+	}
+	for _, p := range rule.Paths {
+		r, err := CompileGlob(p)
+		if err != nil {
+			return fmt.Errorf("paths: %w", err)
+		}
+		rule.paths = append(rule.paths, r)
+	}
+	return nil
+}
+
+// match reports whether the text matched by the pattern is reported in path
+func (rule *Rule) match(path, text string) bool {
+	if len(rule.paths) != 0 {
+		if ok, _ := MatchRegexps(path, rule.paths); !ok {
+			return false
+		}
+	}
+	ok, _ := MatchRegexps(text, rule.exceptions)
+	return !ok
+}
+
+// matchContext reports whether the rule applies to the context of a token in a source file
+func (rule *Rule) matchContext(context string) bool {
+	return context == "" || len(rule.Contexts) == 0 || containsString(rule.Contexts, context)
+}
+
+func containsString(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+// ReadRules reads JSON if the extension is .json, otherwise YAML
+func ReadRules(filename string) ([]*Rule, error) {
+	rf := ruleFile{}
+	if err := config.Read(filename, &rf); err != nil {
+		return nil, fmt.Errorf("read rules: %w", err)
+	}
+	ids := make(map[string]bool)
+	for i, rule := range rf.Rules {
+		if err := rule.compile(); err != nil {
+			return nil, fmt.Errorf("read rules: %s: rules[%d]: %w", filename, i, err)
+		}
+		if ids[rule.ID] {
+			return nil, fmt.Errorf("read rules: %s: rules[%d]: duplicated id %q", filename, i, rule.ID)
+		}
+		ids[rule.ID] = true
+	}
+	return rf.Rules, nil
+}
+
+// Failed reports whether the result fails with the -fail-on threshold.
+// Results without severity, which are found by -black, always fail.
+func (r *Result) Failed(threshold string) bool {
+	rank := SeverityRank(r.Severity)
+	return rank < 0 || rank >= SeverityRank(threshold)
+}
+
+// GroupResults sorts results by severity in descending order and category
+func GroupResults(results []*Result) {
+	sort.SliceStable(results, func(i, j int) bool {
+		a, b := results[i], results[j]
+		if ra, rb := SeverityRank(a.Severity), SeverityRank(b.Severity); ra != rb {
+			return ra > rb
+		}
+		return a.Category < b.Category
+	})
+}
+
+type ResultGroup struct {
+	severity string
+	category string
+	n        int
+}
+
+// SummarizeResults counts results per severity and category in the order of GroupResults
+func SummarizeResults(results []*Result) []ResultGroup {
+	grouped := make([]*Result, len(results))
+	copy(grouped, results)
+	GroupResults(grouped)
+	groups := make([]ResultGroup, 0)
+	for _, r := range grouped {
+		if n := len(groups); n != 0 && groups[n-1].severity == r.Severity && groups[n-1].category == r.Category {
+			groups[n-1].n++
+			continue
+		}
+		groups = append(groups, ResultGroup{severity: r.Severity, category: r.Category, n: 1})
+	}
+	return groups
+}
+
+func (g ResultGroup) String() string {
+	severity, category := g.severity, g.category
+	if severity == "" {
+		severity = "-"
+	}
+	if category == "" {
+		category = "-"
+	}
+	return fmt.Sprintf("%s %s: %d", severity, category, g.n)
+}
+
+// CompileGlob converts glob to regexp.
+// "*" and "?" do not match "/", and "**" matches any string.
+func CompileGlob(glob string) (*regexp.Regexp, error) {
+	buf := strings.Builder{}
+	buf.WriteString("^")
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; {
+		case c == '*' && i+1 < len(glob) && glob[i+1] == '*':
+			buf.WriteString(".*")
+			i++
+		case c == '*':
+			buf.WriteString("[^/]*")
+		case c == '?':
+			buf.WriteString("[^/]")
+		default:
+			buf.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	buf.WriteString("$")
+	return regexp.Compile(buf.String())
+}
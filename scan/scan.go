@@ -0,0 +1,416 @@
+// Package scan finds confidential keywords in binaries, archives and source files.
+package scan
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+type Finder struct {
+	blacklist []*regexp.Regexp
+	whitelist []*regexp.Regexp
+	// rules are the blacklist and rule file entries in the order of black
+	rules     []*Rule
+	black     *multiMatcher
+	white     *multiMatcher
+	encodings []string
+	sections  *SectionFilter
+	nFiles    int64
+	cache     *Cache
+	// source lexes C/C++ source files
+	source bool
+	// dump keeps bytes around results for the HTML report
+	dump bool
+	// filter drops noisy tokens of binaries, and nFiltered counts them
+	filter    tokenFilter
+	nFiltered int64
+	// maxDecompressed limits each decompressed payload and zip member
+	maxDecompressed int64
+	// maxFileSize limits files read by Find and Scan
+	maxFileSize int64
+	// root is the directory which rule paths are relative to
+	root string
+}
+
+type Result struct {
+	Path     string `json:"path"`
+	FileType string `json:"filetype"`
+	Section  string `json:"section"`
+	Encoding string `json:"encoding"`
+	Keyword  string `json:"keyword"`
+	Text     string `json:"text"`
+
+	// Offset is the file offset. In archives, it is relative to the member,
+	// and in compressed data, it is relative to the decompressed data.
+	Offset        int64  `json:"offset"`
+	SectionOffset int64  `json:"section_offset"`
+	Address       uint64 `json:"address"`
+	Symbol        string `json:"symbol"`
+	// Compression is the compression layers like "gzip/zlib"
+	Compression string `json:"compression,omitempty"`
+	// Commit and Author introduced the result in git mode
+	Commit string `json:"commit,omitempty"`
+	Author string `json:"author,omitempty"`
+	// Rule, Category and Severity are given by the rule file
+	Rule     string `json:"rule,omitempty"`
+	Category string `json:"category,omitempty"`
+	Severity string `json:"severity,omitempty"`
+	// Context, Line and Column are the position in a source file
+	Context string `json:"context,omitempty"`
+	Line    int    `json:"line,omitempty"`
+	Column  int    `json:"column,omitempty"`
+	// Dump is the bytes around the result from DumpOffset, kept for the HTML report
+	Dump       []byte `json:"dump,omitempty"`
+	DumpOffset int64  `json:"dump_offset,omitempty"`
+}
+
+// region is a part of the scanned file such as an ELF section
+type region struct {
+	path      string
+	filetype  string
+	section   string
+	offset    int64
+	address   uint64
+	symbolize func(offset int64) string
+	// compression of the section itself
+	compression string
+	// data is the contents of the region for dumps
+	data []byte
+}
+
+type ResultWriter interface {
+	Write(r *Result)
+	Flush() error
+}
+
+// ResultWriterImpl writes results as RFC4180 CSV
+type ResultWriterImpl struct {
+	mutex sync.Mutex
+	w     *csv.Writer
+}
+
+type DummyResultWriter struct {
+}
+
+func CompileRegexps(regexps []string) []*regexp.Regexp {
+	compiled := make([]*regexp.Regexp, 0, len(regexps))
+	for _, reg := range regexps {
+		r := regexp.MustCompile(reg)
+		compiled = append(compiled, r)
+	}
+	return compiled
+}
+
+func MatchRegexps(str string, regexps []*regexp.Regexp) (bool, *regexp.Regexp) {
+	for _, reg := range regexps {
+		if reg.MatchString(str) {
+			return true, reg
+		}
+	}
+	return false, nil
+}
+
+func matchAllRegexps(str string, regexps []*regexp.Regexp) []*regexp.Regexp {
+	r := make([]*regexp.Regexp, 0)
+	for _, reg := range regexps {
+		if reg.MatchString(str) {
+			r = append(r, reg)
+		}
+	}
+	return r
+}
+
+func NewFinder(blacklist, whitelist []*regexp.Regexp) *Finder {
+	rules := make([]*Rule, 0, len(blacklist))
+	for _, r := range blacklist {
+		rules = append(rules, newBlacklistRule(r))
+	}
+	return &Finder{
+		blacklist: blacklist,
+		whitelist: whitelist,
+		rules:     rules,
+		black:     newMultiMatcher(blacklist),
+		white:     newMultiMatcher(whitelist),
+		encodings: []string{EncodingASCII},
+		sections:  newDefaultSectionFilter(),
+
+		maxDecompressed: DefaultMaxDecompressedSize,
+		maxFileSize:     DefaultMaxFileSize,
+	}
+}
+
+// AddRules adds rules read from a rule file to the blacklist
+func (b *Finder) AddRules(rules []*Rule) {
+	b.rules = append(b.rules, rules...)
+	patterns := make([]*regexp.Regexp, 0, len(b.rules))
+	for _, rule := range b.rules {
+		patterns = append(patterns, rule.pattern)
+	}
+	b.black = newMultiMatcher(patterns)
+}
+
+func (b *Finder) SetEncodings(encodings []string) {
+	b.encodings = encodings
+}
+
+func (b *Finder) SetSectionFilter(sections *SectionFilter) {
+	b.sections = sections
+}
+
+// SetRoot makes rule paths relative to root, such as the input directory
+func (b *Finder) SetRoot(root string) {
+	b.root = root
+}
+
+// RelPath returns path relative to root with slashes, which rule paths are matched against.
+// Archive members keep their member paths like "dist/fw.zip!lib/a.so".
+// path is returned as it is if root is empty or path is not in root.
+func RelPath(root, path string) string {
+	if root == "" {
+		return path
+	}
+	rel, err := filepath.Rel(root, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return path
+	}
+	return filepath.ToSlash(rel)
+}
+
+func (reg *region) newResult(offset int, encoding, keyword, text string) *Result {
+	r := &Result{
+		Path:     reg.path,
+		FileType: reg.filetype,
+		Section:  reg.section,
+		Encoding: encoding,
+		Keyword:  keyword,
+		Text:     text,
+		Offset:   reg.offset + int64(offset),
+
+		Compression: reg.compression,
+	}
+	if reg.section != "" {
+		r.SectionOffset = int64(offset)
+	}
+	if reg.address != 0 {
+		r.Address = reg.address + uint64(offset)
+	}
+	if reg.symbolize != nil {
+		r.Symbol = reg.symbolize(int64(offset))
+	}
+	return r
+}
+
+// findToken writes results of the token at offset of reg.
+// context is the context of the token in a source file, or empty in binaries.
+func (b *Finder) findToken(reg *region, offset int, encoding, t, context string, rw ResultWriter) {
+	if b.white.matchAny(t) {
+		return
+	}
+	for _, id := range b.black.matchIDs(t) {
+		rule := b.rules[id]
+		if !rule.match(RelPath(b.root, reg.path), t) || !rule.matchContext(context) {
+			continue
+		}
+		r := reg.newResult(offset, encoding, rule.Pattern, t)
+		r.Rule, r.Category, r.Severity = rule.ID, rule.Category, rule.Severity
+		if b.dump {
+			r.Dump, r.DumpOffset = dumpAround(reg.data, offset, r.Offset)
+		}
+		rw.Write(r)
+	}
+}
+
+func (b *Finder) findBinary(reg *region, data []byte, rw ResultWriter) error {
+	reg.data = data
+	for _, e := range b.encodings {
+		tokenizers[e](data, func(offset int, t, encoding string) {
+			if !b.filter.pass(t) {
+				atomic.AddInt64(&b.nFiltered, 1)
+				return
+			}
+			b.findToken(reg, offset, encoding, t, "", rw)
+		})
+	}
+	return nil
+}
+
+func (b *Finder) findElf(path string, data []byte, rw ResultWriter) error {
+	f, err := elf.NewFile(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	symbolizer := newElfSymbolizer(f)
+	for i, section := range f.Sections {
+		if section.Type == elf.SHT_NULL || section.Type == elf.SHT_NOBITS {
+			continue
+		}
+		if !b.sections.match(section.Name, (section.Flags&elf.SHF_ALLOC) != 0) {
+			continue
+		}
+
+		src, compression, err := elfSectionData(f, data, section, b.maxDecompressed)
+		if err != nil {
+			return err
+		}
+		index := i
+		reg := &region{
+			path:     path,
+			filetype: "elf",
+			section:  section.Name,
+			offset:   int64(section.Offset),
+			address:  section.Addr,
+			symbolize: func(offset int64) string {
+				return symbolizer.lookup(index, offset)
+			},
+			compression: compression,
+		}
+		if compression != "" {
+			reg.offset = 0
+		}
+		err = b.findBinary(reg, src, rw)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *Finder) findData(path string, data []byte, rw ResultWriter) error {
+	if b.source && isSource(path) {
+		return b.findSource(path, data, rw)
+	}
+	if err := b.findArchive(path, data, rw); err != errNotArchive {
+		return err
+	}
+	if err := b.findCompressed(path, data, rw); err != errNotArchive {
+		return err
+	}
+	// broken ELF files are scanned raw, but not ones with sections over the limit
+	if err := b.findElf(path, data, rw); err == nil || errors.Is(err, errTooLarge) {
+		return err
+	}
+	if b.findPE(path, data, rw) == nil {
+		return nil
+	}
+	if b.findMacho(path, data, rw) == nil {
+		return nil
+	}
+	return b.findBinary(&region{path: path, filetype: "bin"}, data, rw)
+}
+
+// DefaultMaxFileSize is the default limit of files read by Find and Scan,
+// which are read into memory as a whole
+const DefaultMaxFileSize int64 = 1 << 30
+
+// SetMaxFileSize limits files read by Find and Scan to n bytes, and larger files are errors
+func (b *Finder) SetMaxFileSize(n int64) {
+	b.maxFileSize = n
+}
+
+// checkFileSize returns an error if a file of size is over the limit
+func (b *Finder) checkFileSize(size int64) error {
+	if size > b.maxFileSize {
+		return fmt.Errorf("file size %d exceeds the limit of %d bytes", size, b.maxFileSize)
+	}
+	return nil
+}
+
+func (b *Finder) readFile(path string) ([]byte, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := b.checkFileSize(info.Size()); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return ioutil.ReadFile(path)
+}
+
+func (b *Finder) Find(path string, rw ResultWriter) error {
+	atomic.AddInt64(&b.nFiles, 1)
+	if b.cache != nil {
+		if err := b.findCached(path, rw); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		return nil
+	}
+
+	data, err := b.readFile(path)
+	if err != nil {
+		return err
+	}
+	if err := b.findData(path, data, rw); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
+
+// FindData scans data read from path by the caller, such as a blob in a repository.
+// It is counted as a file like Find, but the cache is not used.
+func (b *Finder) FindData(path string, data []byte, rw ResultWriter) error {
+	atomic.AddInt64(&b.nFiles, 1)
+	if err := b.findData(path, data, rw); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
+
+// RescanData scans data like FindData without counting it as a file,
+// such as other versions of a file which is already counted.
+func (b *Finder) RescanData(path string, data []byte, rw ResultWriter) error {
+	if err := b.findData(path, data, rw); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
+
+// Files returns the number of files passed to Find, FindData and Scan
+func (b *Finder) Files() int64 {
+	return atomic.LoadInt64(&b.nFiles)
+}
+
+func NewResultWriter(w io.Writer) ResultWriter {
+	if w == nil {
+		return &DummyResultWriter{}
+	}
+	// RFC4180 ends records with CRLF
+	cw := csv.NewWriter(w)
+	cw.UseCRLF = true
+	return &ResultWriterImpl{
+		w: cw,
+	}
+}
+
+func (rw *ResultWriterImpl) Write(r *Result) {
+	rw.mutex.Lock()
+	defer rw.mutex.Unlock()
+	rw.w.Write(r.CSVRecord())
+	rw.w.Flush()
+}
+
+func (rw *ResultWriterImpl) Flush() error {
+	rw.mutex.Lock()
+	defer rw.mutex.Unlock()
+	rw.w.Flush()
+	return rw.w.Error()
+}
+
+func (dw *DummyResultWriter) Write(r *Result) {
+}
+
+func (dw *DummyResultWriter) Flush() error {
+	return nil
+}
@@ -0,0 +1,941 @@
+package scan
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"debug/elf"
+	"debug/macho"
+	"debug/pe"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+var blacklist = CompileRegexps([]string{"(?i)hellO", "(?i)wOr"})
+var whitelist = CompileRegexps([]string{"WOR"})
+
+type collectResultWriter struct {
+	lines []string
+}
+
+func (c *collectResultWriter) Write(r *Result) {
+	c.lines = append(c.lines, strings.Join(r.CSVRecord()[:sizeOfKeyFields], ","))
+}
+
+func (c *collectResultWriter) Flush() error {
+	return nil
+}
+
+func createAr(members map[string]string) []byte {
+	buf := bytes.NewBufferString(arMagic)
+	for name, body := range members {
+		fmt.Fprintf(buf, "%-16s%-12s%-6s%-6s%-8s%-10d`\n", name+"/", "0", "0", "0", "644", len(body))
+		buf.WriteString(body)
+		if len(body)%2 == 1 {
+			buf.WriteString("\n")
+		}
+	}
+	return buf.Bytes()
+}
+
+// buildTestProgram builds the main package src for goos/amd64 with the go command
+func buildTestProgram(t *testing.T, goos, src string) []byte {
+	goCmd, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("the go command is not found")
+	}
+	dir, err := ioutil.TempDir("", "cw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "main.go"), []byte(src), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(goCmd, "build", "-o", "prog", "main.go")
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "GOOS="+goos, "GOARCH=amd64", "CGO_ENABLED=0", "GO111MODULE=off", "GOFLAGS=")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("go build: %v\n%s", err, out)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, "prog"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// testProgram keeps marker in .noptrdata as the symbol main.marker,
+// and its DWARF sections are compressed by the linker
+const testProgram = `package main
+
+var marker = [...]byte{0, 'H', 'e', 'l', 'l', 'o', ' ', 'M', 'a', 'r', 'k', 'e', 'r', 0}
+
+func main() {
+	println(string(marker[:]))
+}
+`
+
+func TestArchive(t *testing.T) {
+	ar := createAr(map[string]string{"foo.o": "\x00Hello\x00"})
+
+	buf := bytes.NewBuffer(nil)
+	zw := zip.NewWriter(buf)
+	w, err := zw.Create("lib/libfoo.a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write(ar)
+	zw.Close()
+
+	rw := &collectResultWriter{}
+	b := NewFinder(blacklist, whitelist)
+	err = b.findData("bundle.zip", buf.Bytes(), rw)
+	if err != nil {
+		t.Fatalf("unexpected err = %v\n", err)
+	}
+	expect := "bundle.zip!lib/libfoo.a!foo.o,bin,,ascii,(?i)hellO,Hello"
+	if len(rw.lines) != 1 || rw.lines[0] != expect {
+		t.Fatalf("expected = %v, actual = %v\n", expect, rw.lines)
+	}
+}
+
+func TestCompression(t *testing.T) {
+	compressors := map[string]func(w io.Writer) (io.WriteCloser, error){
+		"gzip": func(w io.Writer) (io.WriteCloser, error) {
+			return gzip.NewWriter(w), nil
+		},
+		"xz": func(w io.Writer) (io.WriteCloser, error) {
+			return xz.NewWriter(w)
+		},
+		"zstd": func(w io.Writer) (io.WriteCloser, error) {
+			return zstd.NewWriter(w)
+		},
+	}
+	tarball := bytes.NewBuffer(nil)
+	tw := tar.NewWriter(tarball)
+	tw.WriteHeader(&tar.Header{Name: "foo.txt", Mode: 0644, Size: 7})
+	tw.Write([]byte("\x00Hello\x00"))
+	tw.Close()
+
+	for compression, compressor := range compressors {
+		for name, data := range map[string][]byte{"a": []byte("\x00Hello\x00"), "a!foo.txt": tarball.Bytes()} {
+			buf := bytes.NewBuffer(nil)
+			w, err := compressor(buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			w.Write(data)
+			w.Close()
+
+			rw := &ResultCollector{}
+			b := NewFinder(blacklist, whitelist)
+			if err := b.findData("a", buf.Bytes(), rw); err != nil {
+				t.Fatalf("%s: unexpected err = %v\n", compression, err)
+			}
+			if len(rw.Results) != 1 {
+				t.Fatalf("%s: expected 1 result, actual = %v\n", compression, rw.Results)
+			}
+			r := rw.Results[0]
+			if r.Path != name || r.Compression != compression || r.Offset != 1 {
+				t.Fatalf("%s: unexpected result = %+v\n", compression, r)
+			}
+		}
+	}
+
+	buf := bytes.NewBuffer(nil)
+	w := gzip.NewWriter(buf)
+	w.Write(make([]byte, 1<<20))
+	w.Write([]byte("\x00Hello\x00"))
+	w.Close()
+	rw := &ResultCollector{}
+	b := NewFinder(blacklist, whitelist)
+	if err := b.findData("a", buf.Bytes(), rw); err != nil {
+		t.Fatalf("unexpected err = %v\n", err)
+	}
+	if len(rw.Results) != 1 || rw.Results[0].Compression != CompressionGzip {
+		t.Fatalf("expected 1 decompressed result, actual = %v\n", rw.Results)
+	}
+	// the payload over the limit is an error rather than scanned raw
+	b.SetMaxDecompressedSize(1 << 10)
+	if err := b.findData("a", buf.Bytes(), &ResultCollector{}); !errors.Is(err, errTooLarge) {
+		t.Fatalf("expected too large error, actual = %v\n", err)
+	}
+
+	data := buildTestProgram(t, "linux", testProgram)
+	f, err := elf.NewFile(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	compressed := false
+	for _, section := range f.Sections {
+		compressed = compressed || section.Flags&elf.SHF_COMPRESSED != 0
+	}
+	if !compressed {
+		t.Skip("DWARF sections are not compressed")
+	}
+	sf, _ := ParseSectionFilter(SectionsAll, "")
+	b.SetSectionFilter(sf)
+	if err := b.findData("a", data, &ResultCollector{}); !errors.Is(err, errTooLarge) {
+		t.Fatalf("expected too large error of compressed sections, actual = %v\n", err)
+	}
+}
+
+func TestSymbol(t *testing.T) {
+	data := buildTestProgram(t, "linux", testProgram)
+	f, err := elf.NewFile(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	symbols, err := f.Symbols()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var marker *elf.Symbol
+	for i := range symbols {
+		if symbols[i].Name == "main.marker" {
+			marker = &symbols[i]
+		}
+	}
+	if marker == nil {
+		t.Fatalf("main.marker is not found\n")
+	}
+	section := f.Sections[marker.Section]
+
+	rw := &ResultCollector{}
+	if err := NewFinder(blacklist, whitelist).findData("prog", data, rw); err != nil {
+		t.Fatalf("unexpected err = %v\n", err)
+	}
+	var r *Result
+	for _, result := range rw.Results {
+		if result.Text == "Hello Marker" {
+			r = result
+		}
+	}
+	// the text follows the leading NUL of the marker
+	address := marker.Value + 1
+	if r == nil || r.Section != section.Name || r.Symbol != "main.marker" || r.Address != address ||
+		r.SectionOffset != int64(address-section.Addr) || r.Offset != int64(section.Offset)+r.SectionOffset {
+		t.Fatalf("unexpected result = %+v, symbol = %+v\n", r, marker)
+	}
+}
+
+// fatMacho returns a fat Mach-O file of the thin amd64 file
+func fatMacho(thin []byte) []byte {
+	const offset = 4096
+	header := []uint32{0xcafebabe, 1, uint32(macho.CpuAmd64), 3, offset, uint32(len(thin)), 12}
+	buf := bytes.NewBuffer(nil)
+	binary.Write(buf, binary.BigEndian, header)
+	buf.Write(make([]byte, offset-buf.Len()))
+	buf.Write(thin)
+	return buf.Bytes()
+}
+
+func TestExecutables(t *testing.T) {
+	exe := buildTestProgram(t, "windows", testProgram)
+	thin := buildTestProgram(t, "darwin", testProgram)
+	fat := fatMacho(thin)
+	pf, err := pe.NewFile(bytes.NewReader(exe))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mf, err := macho.NewFile(bytes.NewReader(thin))
+	if err != nil {
+		t.Fatal(err)
+	}
+	peData := int64(pf.Section(".data").Offset)
+	machoData := int64(mf.Section("__noptrdata").Offset)
+	var tests = []struct {
+		name     string
+		data     []byte
+		path     string
+		filetype string
+		section  string
+		// base is the offset of the member in data
+		base          int64
+		sectionOffset int64
+	}{
+		{name: "a.exe", data: exe, path: "a.exe", filetype: "pe", section: ".data", sectionOffset: peData},
+		{name: "a", data: thin, path: "a", filetype: "macho", section: "__DATA.__noptrdata", sectionOffset: machoData},
+		{name: "fat", data: fat, path: "fat!" + macho.CpuAmd64.String(), filetype: "macho", section: "__DATA.__noptrdata", base: 4096, sectionOffset: machoData},
+	}
+	for _, test := range tests {
+		rw := &ResultCollector{}
+		if err := NewFinder(blacklist, whitelist).findData(test.name, test.data, rw); err != nil {
+			t.Fatalf("%s: unexpected err = %v\n", test.name, err)
+		}
+		var r *Result
+		for _, result := range rw.Results {
+			if result.Text == "Hello Marker" {
+				r = result
+			}
+		}
+		if r == nil || r.Path != test.path || r.FileType != test.filetype || r.Section != test.section {
+			t.Fatalf("%s: unexpected result = %+v\n", test.name, r)
+		}
+		offset := test.base + r.Offset
+		if r.SectionOffset == 0 || !bytes.HasPrefix(test.data[offset:], []byte("Hello Marker")) {
+			t.Fatalf("%s: unexpected offset = %d(section offset %d)\n", test.name, r.Offset, r.SectionOffset)
+		}
+		if r.Offset-r.SectionOffset != test.sectionOffset || r.Symbol != "main.marker" {
+			t.Fatalf("%s: unexpected section = %d, symbol = %s\n", test.name, r.Offset-r.SectionOffset, r.Symbol)
+		}
+	}
+}
+
+func TestMaxFileSize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	data := []byte("\x00Hello\x00")
+	path := filepath.Join(dir, "a.bin")
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	for limit, fail := range map[int64]bool{7: false, 6: true} {
+		b := NewFinder(blacklist, whitelist)
+		b.SetMaxFileSize(limit)
+		rw := &ResultCollector{}
+		if err := b.Find(path, rw); (err != nil) != fail || (len(rw.Results) == 1) == fail {
+			t.Fatalf("%d: unexpected results = %v, err = %v\n", limit, rw.Results, err)
+		}
+		n := 0
+		for f := range b.Scan(context.Background(), fstest.MapFS{"a.bin": {Data: data}}) {
+			if (f.Err != nil) != fail {
+				t.Fatalf("%d: unexpected finding = %+v\n", limit, f)
+			}
+			n++
+		}
+		if n != 1 {
+			t.Fatalf("%d: expected 1 finding, actual = %d\n", limit, n)
+		}
+	}
+}
+
+func TestRawData(t *testing.T) {
+	// zeros are not a COFF object
+	data := append(make([]byte, 100), "\x00Hello\x00"...)
+	rw := &ResultCollector{}
+	b := NewFinder(blacklist, whitelist)
+	if err := b.findData("a", data, rw); err != nil {
+		t.Fatalf("unexpected err = %v\n", err)
+	}
+	if len(rw.Results) != 1 || rw.Results[0].FileType != "bin" {
+		t.Fatalf("expected 1 result in bin, actual = %v\n", rw.Results)
+	}
+}
+
+func TestDetectFileType(t *testing.T) {
+	tarball := bytes.NewBuffer(nil)
+	tw := tar.NewWriter(tarball)
+	tw.WriteHeader(&tar.Header{Name: "foo.txt", Mode: 0644, Size: 7})
+	tw.Write([]byte("\x00Hello\x00"))
+	tw.Close()
+	gz := func(data []byte) []byte {
+		buf := bytes.NewBuffer(nil)
+		w := gzip.NewWriter(buf)
+		w.Write(data)
+		w.Close()
+		return buf.Bytes()
+	}
+	pe := make([]byte, 0x84)
+	copy(pe, "MZ")
+	pe[0x3c] = 0x80
+	copy(pe[0x80:], "PE\x00\x00")
+
+	var tests = []struct {
+		data   []byte
+		expect string
+	}{
+		{data: []byte("\x7fELF\x02"), expect: FileTypeELF},
+		{data: tarball.Bytes(), expect: FileTypeTar},
+		{data: gz(tarball.Bytes()), expect: FileTypeTar},
+		{data: gz([]byte("Hello")), expect: CompressionGzip},
+		{data: pe, expect: FileTypePE},
+		{data: []byte("MZ is not always PE" + strings.Repeat(".", 100)), expect: FileTypeBin},
+	}
+	for i, test := range tests {
+		data := test.data
+		if len(data) > MagicSize {
+			data = data[:MagicSize]
+		}
+		if actual := DetectFileType(data); actual != test.expect {
+			t.Fatalf("%d: expected = %s, actual = %s\n", i, test.expect, actual)
+		}
+	}
+	types, err := ParseFileTypeFilter("elf,archive", "")
+	if err != nil || !types.Match(DetectFileType(gz(tarball.Bytes()))) {
+		t.Fatalf("tar.gz should match archive\n")
+	}
+}
+
+func TestEncodings(t *testing.T) {
+	var tests = []struct {
+		encoding string
+		data     []byte
+		expect   string
+	}{
+		{encoding: "ascii", data: []byte("\x00Hello\x00"), expect: "ascii:Hello"},
+		{encoding: "utf8", data: []byte("\x00こんにちはHello\x00"), expect: "utf8:こんにちはHello"},
+		{encoding: "utf16le", data: []byte("\x00\x00H\x00e\x00l\x00l\x00o\x00\x00\x00"), expect: "utf16le:Hello"},
+		{encoding: "utf16be", data: []byte("\x00\x00\x00H\x00e\x00l\x00l\x00o\x00\x00"), expect: "utf16be:Hello"},
+	}
+	for _, test := range tests {
+		encodings, err := ParseEncodings(test.encoding)
+		if err != nil {
+			t.Fatalf("unexpected err = %v\n", err)
+		}
+		rw := &collectResultWriter{}
+		b := NewFinder(blacklist, whitelist)
+		b.SetEncodings(encodings)
+		b.findBinary(&region{path: "a", filetype: "bin"}, test.data, rw)
+		if len(rw.lines) != 1 {
+			t.Fatalf("%s: expected 1 result, actual = %v\n", test.encoding, rw.lines)
+		}
+		f := strings.Split(rw.lines[0], ",")
+		if actual := f[3] + ":" + f[5]; actual != test.expect {
+			t.Fatalf("expected = %s, actual = %s\n", test.expect, actual)
+		}
+	}
+}
+
+func TestFormat(t *testing.T) {
+	r := &Result{Path: "a.zip!b", FileType: "bin", Encoding: "ascii", Keyword: "(?i)hellO", Text: `Hello, "World"`, Offset: 16}
+	var tests = []struct {
+		format string
+		expect string
+	}{
+		{format: "csv", expect: "a.zip!b,bin,,ascii,(?i)hellO,\"Hello, \"\"World\"\"\",16,0,0x0,,,,,,,,,0,0\r\n"},
+		{format: "jsonl", expect: `{"path":"a.zip!b","filetype":"bin","section":"","encoding":"ascii","keyword":"(?i)hellO","text":"Hello, \"World\"","offset":16,"section_offset":0,"address":0,"symbol":""}` + "\n"},
+	}
+	for _, test := range tests {
+		buf := bytes.NewBuffer(nil)
+		rw, err := NewFormatResultWriter(test.format, buf)
+		if err != nil {
+			t.Fatalf("unexpected err = %v\n", err)
+		}
+		rw.Write(r)
+		if err := rw.Flush(); err != nil {
+			t.Fatalf("unexpected err = %v\n", err)
+		}
+		if buf.String() != test.expect {
+			t.Fatalf("expected = %s, actual = %s\n", test.expect, buf.String())
+		}
+	}
+	for _, format := range []string{"sarif", "junit"} {
+		buf := bytes.NewBuffer(nil)
+		rw, _ := NewFormatResultWriter(format, buf)
+		rw.Write(r)
+		if err := rw.Flush(); err != nil {
+			t.Fatalf("unexpected err = %v\n", err)
+		}
+		if !strings.Contains(buf.String(), "a.zip!b") {
+			t.Fatalf("%s: path not found: %s\n", format, buf.String())
+		}
+	}
+
+	// results of source files have lines and columns in the SARIF region
+	buf := bytes.NewBuffer(nil)
+	rw, _ := NewFormatResultWriter(FormatSARIF, buf)
+	rw.Write(r)
+	rw.Write(&Result{Path: "a.c", FileType: "source", Keyword: "(?i)hellO", Text: "Hello", Offset: 30, Line: 3, Column: 5})
+	if err := rw.Flush(); err != nil {
+		t.Fatalf("unexpected err = %v\n", err)
+	}
+	log := sarifLog{}
+	if err := json.Unmarshal(buf.Bytes(), &log); err != nil {
+		t.Fatalf("unexpected err = %v\n", err)
+	}
+	actual := make([]string, 0)
+	for _, result := range log.Runs[0].Results {
+		region := result.Locations[0].PhysicalLocation.Region
+		actual = append(actual, fmt.Sprintf("%d:%d:%d", region.ByteOffset, region.StartLine, region.StartColumn))
+	}
+	if expect := []string{"16:0:0", "30:3:5"}; strings.Join(actual, " ") != strings.Join(expect, " ") {
+		t.Fatalf("expected = %v, actual = %v\n", expect, actual)
+	}
+}
+
+func TestPassListKey(t *testing.T) {
+	r := &Result{Path: "a", FileType: "elf", Section: ".rodata", Encoding: "ascii", Keyword: "k", Text: "t", Offset: 100, Address: 0x400}
+	line := csvLine(r.CSVRecord())
+	if CSVKeyOfLine(line) != r.CSVKey() {
+		t.Fatalf("expected = %s, actual = %s\n", r.CSVKey(), CSVKeyOfLine(line))
+	}
+	if CSVKeyOfLine("a,elf,.rodata,ascii,k,t") != r.CSVKey() {
+		t.Fatalf("line without offsets should match: %s\n", r.CSVKey())
+	}
+	if CSVKeyOfLine("a,elf,.rodata,k,t") != r.CSVKey() {
+		t.Fatalf("legacy line without encoding should match: %s\n", r.CSVKey())
+	}
+}
+
+func TestSectionFilter(t *testing.T) {
+	var tests = []struct {
+		include  string
+		exclude  string
+		name     string
+		loadable bool
+		expect   bool
+	}{
+		{include: "", name: ".rodata", loadable: true, expect: true},
+		{include: "", name: ".comment", loadable: false, expect: false},
+		{include: "data,.comment", name: ".comment", loadable: false, expect: true},
+		{include: "all", exclude: ".debug_*", name: ".debug_str", loadable: false, expect: false},
+		{include: "all", exclude: ".debug_*", name: ".symtab", loadable: false, expect: true},
+		{include: ".rodata*", name: ".rodata.str1.1", loadable: true, expect: true},
+		{include: ".rodata*", name: ".data", loadable: true, expect: false},
+	}
+	for _, test := range tests {
+		sf, err := ParseSectionFilter(test.include, test.exclude)
+		if err != nil {
+			t.Fatalf("unexpected err = %v\n", err)
+		}
+		if actual := sf.match(test.name, test.loadable); actual != test.expect {
+			t.Fatalf("%s(-sections %q -exclude-sections %q): expected = %v, actual = %v\n",
+				test.name, test.include, test.exclude, test.expect, actual)
+		}
+	}
+}
+
+func TestSectionFilterELF(t *testing.T) {
+	// marker is in .noptrdata, which is loadable, and its name is in .strtab, which is not
+	data := buildTestProgram(t, "linux", testProgram)
+	var tests = []struct {
+		include string
+		exclude string
+		expect  map[string]bool
+	}{
+		{expect: map[string]bool{".noptrdata": true, ".strtab": false}},
+		{include: SectionsAll, expect: map[string]bool{".noptrdata": true, ".strtab": true}},
+		{include: ".strtab", expect: map[string]bool{".noptrdata": false, ".strtab": true}},
+		{include: SectionsAll, exclude: ".noptr*", expect: map[string]bool{".noptrdata": false, ".strtab": true}},
+	}
+	for _, test := range tests {
+		sf, err := ParseSectionFilter(test.include, test.exclude)
+		if err != nil {
+			t.Fatalf("unexpected err = %v\n", err)
+		}
+		b := NewFinder(CompileRegexps([]string{"(?i)marker"}), nil)
+		b.SetSectionFilter(sf)
+		rw := &ResultCollector{}
+		if err := b.findData("prog", data, rw); err != nil {
+			t.Fatalf("unexpected err = %v\n", err)
+		}
+		found := make(map[string]bool)
+		for _, r := range rw.Results {
+			found[r.Section] = true
+		}
+		for section, expect := range test.expect {
+			if found[section] != expect {
+				t.Fatalf("-sections %q -exclude-sections %q: %s expected = %v, actual = %v\n",
+					test.include, test.exclude, section, expect, found)
+			}
+		}
+	}
+}
+
+func TestMultiMatcher(t *testing.T) {
+	regexps := CompileRegexps([]string{"(?i)hellO", "wor", "^Hel+o", "he", "ＡＢＣ", "(?i)k", "said [a-z]+", ""})
+	m := newMultiMatcher(regexps)
+	for _, text := range []string{"Hello World", "HELLO WORLD", "she said", "she said hello", "ＡＢＣ", "\u212A", "", "xyz"} {
+		expect := matchAllRegexps(text, regexps)
+		actual := m.matchAll(text)
+		if fmt.Sprint(expect) != fmt.Sprint(actual) {
+			t.Fatalf("%q: expected = %v, actual = %v\n", text, expect, actual)
+		}
+	}
+}
+
+// createKeywords returns n literal keywords and n/10 regexps like a large compliance list
+func createKeywords(n int) []*regexp.Regexp {
+	keywords := make([]string, 0, n+n/10)
+	for i := 0; i < n; i++ {
+		keywords = append(keywords, fmt.Sprintf("(?i)customer%dname", i))
+	}
+	for i := 0; i < n/10; i++ {
+		keywords = append(keywords, fmt.Sprintf("host%d\\.example\\.(com|net)", i))
+	}
+	return CompileRegexps(keywords)
+}
+
+func createBinary() []byte {
+	buf := bytes.NewBuffer(nil)
+	for i := 0; i < 10000; i++ {
+		fmt.Fprintf(buf, "token %d of the binary\x00\x01", i)
+	}
+	buf.WriteString("customer42name\x00host7.example.com\x00")
+	return buf.Bytes()
+}
+
+func benchmarkKeywords(b *testing.B, n int, naive bool) {
+	keywords := createKeywords(n)
+	data := createBinary()
+	f := NewFinder(keywords, whitelist)
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if naive {
+			tokenizeASCII(data, func(offset int, t, encoding string) {
+				if match, _ := MatchRegexps(t, whitelist); match {
+					return
+				}
+				matchAllRegexps(t, keywords)
+			})
+			continue
+		}
+		f.findBinary(&region{path: "a", filetype: "bin"}, data, &DummyResultWriter{})
+	}
+}
+
+func BenchmarkKeywords100(b *testing.B)       { benchmarkKeywords(b, 100, false) }
+func BenchmarkKeywords1000(b *testing.B)      { benchmarkKeywords(b, 1000, false) }
+func BenchmarkKeywords5000(b *testing.B)      { benchmarkKeywords(b, 5000, false) }
+func BenchmarkNaiveKeywords100(b *testing.B)  { benchmarkKeywords(b, 100, true) }
+func BenchmarkNaiveKeywords1000(b *testing.B) { benchmarkKeywords(b, 1000, true) }
+
+func TestRules(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "rules.yaml")
+	err = ioutil.WriteFile(filename, []byte(`rules:
+  - id: customer-acme
+    category: customer name
+    severity: high
+    pattern: "(?i)acme"
+    exceptions: ["(?i)acme-open"]
+  - id: internal-host
+    category: internal hostname
+    severity: low
+    pattern: "\\.corp\\.example\\.com"
+    paths: ["firmware/**"]
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rules, err := ReadRules(filename)
+	if err != nil {
+		t.Fatalf("unexpected err = %v\n", err)
+	}
+
+	b := NewFinder(nil, whitelist)
+	b.AddRules(rules)
+	rw := &ResultCollector{}
+	data := []byte("\x00ACME Inc.\x00acme-open\x00build.corp.example.com\x00")
+	b.findBinary(&region{path: "firmware/a.bin", filetype: "bin"}, data, rw)
+	b.findBinary(&region{path: "docs/a.bin", filetype: "bin"}, data, rw)
+	actual := make([]string, 0)
+	for _, r := range rw.Results {
+		actual = append(actual, fmt.Sprintf("%s,%s,%s,%s,%s", r.Path, r.Text, r.Rule, r.Category, r.Severity))
+	}
+	expect := []string{
+		"firmware/a.bin,ACME Inc.,customer-acme,customer name,high",
+		"firmware/a.bin,build.corp.example.com,internal-host,internal hostname,low",
+		"docs/a.bin,ACME Inc.,customer-acme,customer name,high",
+	}
+	if strings.Join(actual, "\n") != strings.Join(expect, "\n") {
+		t.Fatalf("expected = %v, actual = %v\n", expect, actual)
+	}
+
+	if !rw.Results[0].Failed("high") || rw.Results[1].Failed("medium") {
+		t.Fatalf("unexpected -fail-on threshold\n")
+	}
+	if (&Result{}).Failed("critical") == false {
+		t.Fatalf("results without severity should always fail\n")
+	}
+	summary := make([]string, 0)
+	for _, g := range SummarizeResults(rw.Results) {
+		summary = append(summary, g.String())
+	}
+	expect = []string{"high customer name: 2", "low internal hostname: 1"}
+	if strings.Join(summary, "\n") != strings.Join(expect, "\n") {
+		t.Fatalf("expected = %v, actual = %v\n", expect, summary)
+	}
+
+	err = ioutil.WriteFile(filename, []byte("rules:\n  - id: a\n    severity: urgent\n    pattern: a\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadRules(filename); err == nil {
+		t.Fatalf("expected unknown severity error\n")
+	}
+}
+
+func TestRuleRoot(t *testing.T) {
+	root, err := ioutil.TempDir("", "cw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	data := []byte("\x00Acme\x00")
+	zipBuf := &bytes.Buffer{}
+	zw := zip.NewWriter(zipBuf)
+	w, _ := zw.Create("lib/a.bin")
+	w.Write(data)
+	zw.Close()
+	files := map[string][]byte{
+		"firmware/a.bin": data,
+		"docs/a.bin":     data,
+		"pkg.zip":        zipBuf.Bytes(),
+	}
+	for name, content := range files {
+		path := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, content, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rule := &Rule{ID: "customer-acme", Severity: "high", Pattern: "Acme", Paths: []string{"firmware/**", "pkg.zip!lib/*"}}
+	if err := rule.compile(); err != nil {
+		t.Fatal(err)
+	}
+	b := NewFinder(nil, nil)
+	b.AddRules([]*Rule{rule})
+	b.SetRoot(root)
+	rw := &ResultCollector{}
+	for _, name := range []string{"docs/a.bin", "firmware/a.bin", "pkg.zip"} {
+		if err := b.Find(filepath.Join(root, name), rw); err != nil {
+			t.Fatalf("unexpected err = %v\n", err)
+		}
+	}
+	actual := make([]string, 0)
+	for _, r := range rw.Results {
+		actual = append(actual, RelPath(root, r.Path))
+	}
+	expect := []string{"firmware/a.bin", "pkg.zip!lib/a.bin"}
+	if strings.Join(actual, "\n") != strings.Join(expect, "\n") {
+		t.Fatalf("expected = %v, actual = %v\n", expect, actual)
+	}
+
+	if p := RelPath(root, "/elsewhere/a.bin"); p != "/elsewhere/a.bin" {
+		t.Fatalf("unexpected path outside root = %s\n", p)
+	}
+	if p := RelPath("", "out/a.bin"); p != "out/a.bin" {
+		t.Fatalf("unexpected path without root = %s\n", p)
+	}
+}
+
+func TestCacheContent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "a.bin")
+	if err := ioutil.WriteFile(path, []byte("\x00Hello\x00"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := NewFinder(blacklist, whitelist)
+	c, err := OpenCache(filepath.Join(dir, "cache"), b.ConfigHash())
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.SetCache(c)
+	for i, text := range []string{"Hello", "Hello", "Howdy"} {
+		// the same size and modification time do not hide the change
+		if err := ioutil.WriteFile(path, []byte("\x00"+text+"\x00"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, info.ModTime(), info.ModTime()); err != nil {
+			t.Fatal(err)
+		}
+		rw := &ResultCollector{}
+		if err := b.Find(path, rw); err != nil {
+			t.Fatalf("unexpected err = %v\n", err)
+		}
+		if expect := strings.Count(text, "Hello"); len(rw.Results) != expect {
+			t.Fatalf("%d: expected %d results, actual = %v\n", i, expect, rw.Results)
+		}
+	}
+	if c.String() != "1 hits, 2 misses" {
+		t.Fatalf("unexpected cache = %s\n", c)
+	}
+}
+
+func TestCachePaths(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	data := []byte("\x00Acme\x00")
+	for _, name := range []string{"src/other/a.bin", "src/fw/a.bin"} {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rule := &Rule{ID: "customer-acme", Severity: "high", Pattern: "Acme", Paths: []string{"**/fw/**"}}
+	if err := rule.compile(); err != nil {
+		t.Fatal(err)
+	}
+	b := NewFinder(nil, nil)
+	b.AddRules([]*Rule{rule})
+	c, err := OpenCache(filepath.Join(dir, "cache"), b.ConfigHash())
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.SetCache(c)
+	for i := 0; i < 2; i++ {
+		rw := &ResultCollector{}
+		for _, name := range []string{"src/other/a.bin", "src/fw/a.bin"} {
+			if err := b.Find(filepath.Join(dir, name), rw); err != nil {
+				t.Fatalf("unexpected err = %v\n", err)
+			}
+		}
+		if len(rw.Results) != 1 || !strings.HasSuffix(rw.Results[0].Path, "src/fw/a.bin") {
+			t.Fatalf("%d: unexpected results = %v\n", i, rw.Results)
+		}
+	}
+	if c.String() != "2 hits, 2 misses" {
+		t.Fatalf("unexpected cache = %s\n", c)
+	}
+}
+
+func TestSource(t *testing.T) {
+	src := "#include <stdio.h>\n" +
+		"/* Hello\n * World */\n" +
+		"int hello_count;\n" +
+		"const char *s = \"say \\\"hello\\\"\"; // hello\n"
+	rules := []*Rule{{ID: "comment-only", Severity: "low", Pattern: "(?i)world", Contexts: []string{contextComment, contextString}}}
+	for _, rule := range rules {
+		if err := rule.compile(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b := NewFinder(CompileRegexps([]string{"(?i)hello"}), nil)
+	b.AddRules(rules)
+	b.SetSourceMode(true)
+	rw := &ResultCollector{}
+	if err := b.findData("a.c", []byte(src), rw); err != nil {
+		t.Fatalf("unexpected err = %v\n", err)
+	}
+	actual := make([]string, 0)
+	for _, r := range rw.Results {
+		actual = append(actual, fmt.Sprintf("%s:%d:%d:%d %s", r.Context, r.Line, r.Column, r.Offset, r.Text))
+	}
+	expect := []string{
+		"comment:2:1:19 /* Hello",
+		"comment:3:1:28  * World */",
+		"ident:4:5:44 hello_count",
+		"string:5:18:74 say \\\"hello\\\"",
+		"comment:5:34:90 // hello",
+	}
+	if strings.Join(actual, "\n") != strings.Join(expect, "\n") {
+		t.Fatalf("expected = %v, actual = %v\n", expect, actual)
+	}
+
+	b.SetSourceMode(false)
+	rw = &ResultCollector{}
+	b.findData("a.c", []byte(src), rw)
+	if len(rw.Results) == 0 || rw.Results[0].FileType != "bin" {
+		t.Fatalf("unexpected results without source mode = %v\n", rw.Results)
+	}
+}
+
+func TestScan(t *testing.T) {
+	rules := []*Rule{
+		{ID: "greeting", Severity: "low", Pattern: "(?i)hello"},
+		{ID: "world", Severity: "medium", Pattern: "World"},
+	}
+	for _, rule := range rules {
+		if err := rule.compile(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fsys := fstest.MapFS{
+		"a.bin":       {Data: []byte("\x00Hello\x00")},
+		"dir/b.bin":   {Data: []byte("\x00World\x00nothing\x00")},
+		"dir/c.a":     {Data: createAr(map[string]string{"foo.o": "\x00hello\x00"})},
+		"dir/empty":   {Data: nil},
+		"dir/sub/d.c": {Data: []byte("xyz")},
+	}
+	actual := make([]string, 0)
+	for f := range Scan(context.Background(), fsys, rules) {
+		if f.Err != nil {
+			t.Fatalf("unexpected err = %v\n", f.Err)
+		}
+		actual = append(actual, fmt.Sprintf("%s,%s,%s", f.Path, f.Text, f.Rule))
+	}
+	expect := []string{
+		"a.bin,Hello,greeting",
+		"dir/b.bin,World,world",
+		"dir/c.a!foo.o,hello,greeting",
+	}
+	if strings.Join(actual, "\n") != strings.Join(expect, "\n") {
+		t.Fatalf("expected = %v, actual = %v\n", expect, actual)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	b := NewFinder(nil, nil)
+	b.AddRules(rules)
+	ch := b.Scan(ctx, fsys)
+	<-ch
+	cancel()
+	for range ch {
+	}
+	if b.Files() == int64(len(fsys)) {
+		t.Fatalf("scan is not canceled\n")
+	}
+}
+
+func TestTokenFilter(t *testing.T) {
+	data := []byte("\x00Hi\x00k#9Qz!@mPv^&wHXy\x00Hello World\x00Q7x@\x00ACME Confidential - do not distribute\x00")
+	var tests = []struct {
+		minLength    int
+		minTextRatio float64
+		expect       []string
+		filtered     int64
+	}{
+		{minLength: 0, minTextRatio: 0, expect: []string{"Hi", "k#9Qz!@mPv^&wHXy", "Hello World", "Q7x@", "ACME Confidential - do not distribute"}, filtered: 0},
+		{minLength: 4, minTextRatio: 0, expect: []string{"k#9Qz!@mPv^&wHXy", "Hello World", "Q7x@", "ACME Confidential - do not distribute"}, filtered: 1},
+		{minLength: 4, minTextRatio: 0.8, expect: []string{"Hello World", "ACME Confidential - do not distribute"}, filtered: 3},
+	}
+	for _, test := range tests {
+		b := NewFinder(CompileRegexps([]string{"(?i)[hqa]"}), nil)
+		b.SetTokenFilter(test.minLength, test.minTextRatio)
+		rw := &ResultCollector{}
+		b.findBinary(&region{path: "a", filetype: "bin"}, data, rw)
+		actual := make([]string, 0)
+		for _, r := range rw.Results {
+			actual = append(actual, r.Text)
+		}
+		if strings.Join(actual, "\n") != strings.Join(test.expect, "\n") || b.Filtered() != test.filtered {
+			t.Fatalf("-min-length %d -min-text-ratio %g: expected = %v(%d filtered), actual = %v(%d filtered)\n",
+				test.minLength, test.minTextRatio, test.expect, test.filtered, actual, b.Filtered())
+		}
+	}
+}
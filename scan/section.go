@@ -0,0 +1,88 @@
+package scan
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+const (
+	// SectionsData selects loadable sections with contents like binutils strings -d,
+	// @see binutils strings.c
+	// #define DATA_FLAGS (SEC_ALLOC | SEC_LOAD | SEC_HAS_CONTENTS)
+	SectionsData = "data"
+	// SectionsAll selects all sections with contents including debug information
+	SectionsAll = "all"
+)
+
+// SectionFilter selects sections to scan by glob patterns such as ".rodata*"
+type SectionFilter struct {
+	include []string
+	exclude []string
+}
+
+func splitPatterns(s string) []string {
+	patterns := make([]string, 0)
+	for _, p := range strings.Split(s, ",") {
+		p = strings.TrimSpace(p)
+		if p != "" {
+			patterns = append(patterns, p)
+		}
+	}
+	return patterns
+}
+
+// ParseSectionFilter parses comma separated patterns.
+// include may contain "data" and "all" besides globs.
+func ParseSectionFilter(include, exclude string) (*SectionFilter, error) {
+	sf := &SectionFilter{
+		include: splitPatterns(include),
+		exclude: splitPatterns(exclude),
+	}
+	if len(sf.include) == 0 {
+		sf.include = []string{SectionsData}
+	}
+	for _, p := range append(sf.include, sf.exclude...) {
+		if _, err := path.Match(p, ""); err != nil {
+			return nil, fmt.Errorf("invalid section pattern %q: %w", p, err)
+		}
+	}
+	return sf, nil
+}
+
+func newDefaultSectionFilter() *SectionFilter {
+	sf, _ := ParseSectionFilter(SectionsData, "")
+	return sf
+}
+
+func matchPatterns(name string, patterns []string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// match reports whether the section should be scanned.
+// loadable means that the section is loaded into memory at runtime.
+func (sf *SectionFilter) match(name string, loadable bool) bool {
+	if matchPatterns(name, sf.exclude) {
+		return false
+	}
+	for _, p := range sf.include {
+		switch p {
+		case SectionsAll:
+			return true
+		case SectionsData:
+			if loadable {
+				return true
+			}
+		default:
+			if ok, _ := path.Match(p, name); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
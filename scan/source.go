@@ -0,0 +1,104 @@
+package scan
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"text/scanner"
+)
+
+// contexts of tokens in source files
+const (
+	contextString  = "string"
+	contextComment = "comment"
+	contextIdent   = "ident"
+)
+
+var contexts = []string{contextString, contextComment, contextIdent}
+
+var sourceExtensions = map[string]bool{
+	".c": true, ".h": true,
+	".cc": true, ".cpp": true, ".cxx": true, ".c++": true,
+	".hh": true, ".hpp": true, ".hxx": true, ".h++": true,
+}
+
+func isSource(path string) bool {
+	return sourceExtensions[strings.ToLower(filepath.Ext(path))]
+}
+
+func (b *Finder) SetSourceMode(source bool) {
+	b.source = source
+}
+
+// sourceResultWriter adds the context and the position of the current token
+type sourceResultWriter struct {
+	rw      ResultWriter
+	context string
+	line    int
+	column  int
+}
+
+func (sw *sourceResultWriter) Write(r *Result) {
+	r.Context, r.Line, r.Column = sw.context, sw.line, sw.column
+	sw.rw.Write(r)
+}
+
+func (sw *sourceResultWriter) Flush() error {
+	return sw.rw.Flush()
+}
+
+func encodingOf(s string) string {
+	if isASCII(s) {
+		return EncodingASCII
+	}
+	return EncodingUTF8
+}
+
+// findSource lexes C/C++ source by text/scanner like cmd/createmock,
+// and scans string and character literals, comments and identifiers.
+// Comments are scanned line by line to report the line of the hit.
+// C++11 raw string literals are not supported.
+func (b *Finder) findSource(path string, data []byte, rw ResultWriter) error {
+	reg := &region{path: path, filetype: "c", data: data}
+	sw := &sourceResultWriter{rw: rw}
+	find := func(offset int, t, context string, pos scanner.Position) {
+		sw.context, sw.line, sw.column = context, pos.Line, pos.Column
+		b.findToken(reg, offset, encodingOf(t), t, context, sw)
+	}
+
+	var s scanner.Scanner
+	s.Init(bytes.NewReader(data))
+	s.Filename = path
+	s.Mode = scanner.ScanIdents | scanner.ScanInts | scanner.ScanFloats |
+		scanner.ScanChars | scanner.ScanStrings | scanner.ScanComments
+	// C escape sequences and multi-character constants are not go syntax, but lexing can go on
+	s.Error = func(s *scanner.Scanner, msg string) {}
+	for tok := s.Scan(); tok != scanner.EOF; tok = s.Scan() {
+		pos := s.Position
+		t := s.TokenText()
+		switch tok {
+		case scanner.Ident:
+			find(pos.Offset, t, contextIdent, pos)
+		case scanner.String, scanner.Char:
+			// without quotes
+			if len(t) < 2 {
+				continue
+			}
+			pos.Offset++
+			pos.Column++
+			find(pos.Offset, t[1:len(t)-1], contextString, pos)
+		case scanner.Comment:
+			for i, line := range strings.Split(t, "\n") {
+				if i != 0 {
+					pos.Line++
+					pos.Column = 1
+				}
+				if text := strings.TrimSuffix(line, "\r"); text != "" {
+					find(pos.Offset, text, contextComment, pos)
+				}
+				pos.Offset += len(line) + 1
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,174 @@
+package scan
+
+import (
+	"debug/dwarf"
+	"debug/elf"
+	"sort"
+)
+
+type addressRange struct {
+	low, high uint64
+	name      string
+}
+
+// elfSymbolizer finds the symbol covering a location in an ELF section.
+// It uses the symbol table first, and DWARF if the symbol table has no answer.
+type elfSymbolizer struct {
+	file        *elf.File
+	relocatable bool
+	symbols     map[elf.SectionIndex][]elf.Symbol
+	dwarfRanges []addressRange
+	dwarfLoaded bool
+}
+
+func newElfSymbolizer(f *elf.File) *elfSymbolizer {
+	s := &elfSymbolizer{
+		file:        f,
+		relocatable: f.Type == elf.ET_REL,
+		symbols:     make(map[elf.SectionIndex][]elf.Symbol),
+	}
+	symbols, _ := f.Symbols()
+	for _, sym := range symbols {
+		switch elf.ST_TYPE(sym.Info) {
+		case elf.STT_SECTION, elf.STT_FILE:
+			continue
+		}
+		if sym.Name == "" {
+			continue
+		}
+		s.symbols[sym.Section] = append(s.symbols[sym.Section], sym)
+	}
+	for _, syms := range s.symbols {
+		sort.SliceStable(syms, func(i, j int) bool {
+			return syms[i].Value < syms[j].Value
+		})
+	}
+	return s
+}
+
+// lookup returns the symbol name which covers offset in the index-th section.
+// If no symbol covers it, the nearest preceding symbol without size is returned.
+func (s *elfSymbolizer) lookup(index int, offset int64) string {
+	section := s.file.Sections[index]
+	// symbol values are section relative in relocatable files, otherwise virtual addresses
+	key := uint64(offset)
+	if !s.relocatable {
+		key += section.Addr
+	}
+
+	syms := s.symbols[elf.SectionIndex(index)]
+	i := sort.Search(len(syms), func(i int) bool {
+		return syms[i].Value > key
+	})
+	for j := i - 1; j >= 0; j-- {
+		if key < syms[j].Value+syms[j].Size {
+			return syms[j].Name
+		}
+	}
+	if i > 0 && syms[i-1].Size == 0 {
+		return syms[i-1].Name
+	}
+
+	if s.relocatable || section.Addr == 0 {
+		return ""
+	}
+	return s.lookupDwarf(key)
+}
+
+func (s *elfSymbolizer) lookupDwarf(addr uint64) string {
+	if !s.dwarfLoaded {
+		s.dwarfLoaded = true
+		if d, err := s.file.DWARF(); err == nil {
+			s.dwarfRanges = loadDwarfRanges(d, s.file)
+		}
+	}
+	for _, r := range s.dwarfRanges {
+		if r.low <= addr && addr < r.high {
+			return r.name
+		}
+	}
+	return ""
+}
+
+// loadDwarfRanges collects address ranges of functions and global variables
+func loadDwarfRanges(d *dwarf.Data, f *elf.File) []addressRange {
+	ranges := make([]addressRange, 0)
+	r := d.Reader()
+	for {
+		e, err := r.Next()
+		if e == nil || err != nil {
+			break
+		}
+		name, _ := e.Val(dwarf.AttrName).(string)
+		if name == "" {
+			continue
+		}
+
+		switch e.Tag {
+		case dwarf.TagSubprogram:
+			rs, err := d.Ranges(e)
+			if err != nil {
+				continue
+			}
+			for _, rng := range rs {
+				ranges = append(ranges, addressRange{low: rng[0], high: rng[1], name: name})
+			}
+		case dwarf.TagVariable:
+			addr, ok := dwarfLocationAddress(e, f)
+			if !ok {
+				continue
+			}
+			size := int64(1)
+			if off, ok := e.Val(dwarf.AttrType).(dwarf.Offset); ok {
+				if t, err := d.Type(off); err == nil && t.Size() > 0 {
+					size = t.Size()
+				}
+			}
+			ranges = append(ranges, addressRange{low: addr, high: addr + uint64(size), name: name})
+		}
+	}
+	return ranges
+}
+
+// dwarfLocationAddress supports only a static location, which is "DW_OP_addr <address>"
+func dwarfLocationAddress(e *dwarf.Entry, f *elf.File) (uint64, bool) {
+	const opAddr = 0x03
+	loc, ok := e.Val(dwarf.AttrLocation).([]byte)
+	if !ok || len(loc) == 0 || loc[0] != opAddr {
+		return 0, false
+	}
+	loc = loc[1:]
+	switch {
+	case f.Class == elf.ELFCLASS64 && len(loc) == 8:
+		return f.ByteOrder.Uint64(loc), true
+	case f.Class == elf.ELFCLASS32 && len(loc) == 4:
+		return uint64(f.ByteOrder.Uint32(loc)), true
+	}
+	return 0, false
+}
+
+type symbol struct {
+	name  string
+	value uint64
+}
+
+// nearestSymbols is used for formats whose symbols have no size
+type nearestSymbols []symbol
+
+func newNearestSymbols(symbols []symbol) nearestSymbols {
+	sort.SliceStable(symbols, func(i, j int) bool {
+		return symbols[i].value < symbols[j].value
+	})
+	return nearestSymbols(symbols)
+}
+
+// lookup returns the nearest preceding symbol of value
+func (ns nearestSymbols) lookup(value uint64) string {
+	i := sort.Search(len(ns), func(i int) bool {
+		return ns[i].value > value
+	})
+	if i == 0 {
+		return ""
+	}
+	return ns[i-1].name
+}
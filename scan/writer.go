@@ -0,0 +1,456 @@
+package scan
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	FormatCSV   = "csv"
+	FormatJSONL = "jsonl"
+	FormatSARIF = "sarif"
+	FormatJUnit = "junit"
+)
+
+// sizeOfKeyFields is the number of leading csv fields which identify a result.
+// Trailing fields such as offsets change on every build, so they are ignored by the pass list.
+const sizeOfKeyFields = 6
+
+func (r *Result) CSVRecord() []string {
+	return []string{r.Path, r.FileType, r.Section, r.Encoding, r.Keyword, r.Text,
+		strconv.FormatInt(r.Offset, 10),
+		strconv.FormatInt(r.SectionOffset, 10),
+		fmt.Sprintf("0x%x", r.Address),
+		r.Symbol,
+		r.Compression,
+		r.Commit,
+		r.Author,
+		r.Rule,
+		r.Category,
+		r.Severity,
+		r.Context,
+		strconv.Itoa(r.Line),
+		strconv.Itoa(r.Column),
+	}
+}
+
+// csvLine returns the RFC4180 line without line break
+func csvLine(record []string) string {
+	buf := bytes.NewBuffer(nil)
+	w := csv.NewWriter(buf)
+	w.Write(record)
+	w.Flush()
+	return strings.TrimSuffix(buf.String(), "\n")
+}
+
+// CSVKey returns the pass list entry of the result
+func (r *Result) CSVKey() string {
+	return csvLine(r.CSVRecord()[:sizeOfKeyFields])
+}
+
+// sizeOfLegacyKeyFields is the number of fields of pass lists written before -encoding,
+// which are path, filetype, section, keyword and text of ascii results
+const sizeOfLegacyKeyFields = 5
+
+// CSVKeyOfLine returns the pass list entry of the line written by ResultWriterImpl.
+// Legacy lines without the encoding are read as ascii results.
+func CSVKeyOfLine(line string) string {
+	record, err := csv.NewReader(strings.NewReader(line)).Read()
+	if err == nil && len(record) == sizeOfLegacyKeyFields {
+		legacy := record
+		record = append([]string{}, legacy[:3]...)
+		record = append(record, EncodingASCII)
+		record = append(record, legacy[3:]...)
+	}
+	if err != nil || len(record) < sizeOfKeyFields {
+		return line
+	}
+	return csvLine(record[:sizeOfKeyFields])
+}
+
+func NewFormatResultWriter(format string, w io.Writer) (ResultWriter, error) {
+	switch format {
+	case FormatCSV:
+		return NewResultWriter(w), nil
+	case FormatJSONL:
+		return &JSONLResultWriter{enc: json.NewEncoder(w)}, nil
+	case FormatSARIF:
+		return &SARIFResultWriter{w: w}, nil
+	case FormatJUnit:
+		return &JUnitResultWriter{w: w}, nil
+	}
+	return nil, fmt.Errorf("unknown format: %q", format)
+}
+
+type JSONLResultWriter struct {
+	enc *json.Encoder
+	err error
+}
+
+func (jw *JSONLResultWriter) Write(r *Result) {
+	if jw.err == nil {
+		jw.err = jw.enc.Encode(r)
+	}
+}
+
+func (jw *JSONLResultWriter) Flush() error {
+	return jw.err
+}
+
+// @see https://docs.oasis-open.org/sarif/sarif/v2.1.0/sarif-v2.1.0.html
+type sarifLog struct {
+	Version string     `json:"version"`
+	Schema  string     `json:"$schema"`
+	Runs    []sarifRun `json:"runs"`
+}
+
+type sarifRun struct {
+	Tool    sarifTool     `json:"tool"`
+	Results []sarifResult `json:"results"`
+}
+
+type sarifTool struct {
+	Driver sarifDriver `json:"driver"`
+}
+
+type sarifDriver struct {
+	Name           string      `json:"name"`
+	InformationURI string      `json:"informationUri"`
+	Rules          []sarifRule `json:"rules"`
+}
+
+type sarifRule struct {
+	ID               string       `json:"id"`
+	ShortDescription sarifMessage `json:"shortDescription"`
+}
+
+type sarifMessage struct {
+	Text string `json:"text"`
+}
+
+type sarifResult struct {
+	RuleID    string          `json:"ruleId"`
+	Level     string          `json:"level"`
+	Message   sarifMessage    `json:"message"`
+	Locations []sarifLocation `json:"locations"`
+}
+
+type sarifLocation struct {
+	PhysicalLocation sarifPhysicalLocation  `json:"physicalLocation"`
+	LogicalLocations []sarifLogicalLocation `json:"logicalLocations,omitempty"`
+}
+
+type sarifPhysicalLocation struct {
+	ArtifactLocation sarifArtifactLocation `json:"artifactLocation"`
+	Region           sarifRegion           `json:"region"`
+}
+
+type sarifRegion struct {
+	ByteOffset  int64 `json:"byteOffset"`
+	StartLine   int   `json:"startLine,omitempty"`
+	StartColumn int   `json:"startColumn,omitempty"`
+}
+
+type sarifLogicalLocation struct {
+	Name string `json:"name"`
+}
+
+type sarifArtifactLocation struct {
+	URI string `json:"uri"`
+}
+
+type SARIFResultWriter struct {
+	w       io.Writer
+	mutex   sync.Mutex
+	results []*Result
+}
+
+func (sw *SARIFResultWriter) Write(r *Result) {
+	sw.mutex.Lock()
+	defer sw.mutex.Unlock()
+	sw.results = append(sw.results, r)
+}
+
+func (sw *SARIFResultWriter) Flush() error {
+	sw.mutex.Lock()
+	defer sw.mutex.Unlock()
+
+	run := sarifRun{
+		Tool: sarifTool{Driver: sarifDriver{
+			Name:           "cw",
+			InformationURI: "https://github.com/yoshitake-hamano/gocmd",
+			Rules:          []sarifRule{},
+		}},
+		Results: []sarifResult{},
+	}
+	rules := make(map[string]bool)
+	for _, r := range sw.results {
+		if !rules[r.ruleID()] {
+			rules[r.ruleID()] = true
+			description := fmt.Sprintf("matches %s", r.Keyword)
+			if r.Category != "" {
+				description = fmt.Sprintf("%s %s", r.Category, description)
+			}
+			run.Tool.Driver.Rules = append(run.Tool.Driver.Rules, sarifRule{
+				ID:               r.ruleID(),
+				ShortDescription: sarifMessage{Text: description},
+			})
+		}
+		loc := sarifLocation{PhysicalLocation: sarifPhysicalLocation{
+			ArtifactLocation: sarifArtifactLocation{URI: filepath.ToSlash(r.Path)},
+			Region:           sarifRegion{ByteOffset: r.Offset, StartLine: r.Line, StartColumn: r.Column},
+		}}
+		if r.Symbol != "" {
+			loc.LogicalLocations = []sarifLogicalLocation{{Name: r.Symbol}}
+		}
+		run.Results = append(run.Results, sarifResult{
+			RuleID:    r.ruleID(),
+			Level:     sarifLevel(r.Severity),
+			Message:   sarifMessage{Text: r.Message()},
+			Locations: []sarifLocation{loc},
+		})
+	}
+
+	enc := json.NewEncoder(sw.w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(&sarifLog{
+		Version: "2.1.0",
+		Schema:  "https://json.schemastore.org/sarif-2.1.0.json",
+		Runs:    []sarifRun{run},
+	})
+}
+
+// ruleID returns the id of the rule file entry, or the keyword of -black
+func (r *Result) ruleID() string {
+	if r.Rule != "" {
+		return r.Rule
+	}
+	return r.Keyword
+}
+
+func sarifLevel(severity string) string {
+	switch severity {
+	case "info", "low":
+		return "note"
+	case "medium":
+		return "warning"
+	}
+	return "error"
+}
+
+func (r *Result) Message() string {
+	where := fmt.Sprintf("%s offset 0x%x", r.FileType, r.Offset)
+	if r.Line != 0 {
+		where = fmt.Sprintf("%s %s at %d:%d", r.FileType, r.Context, r.Line, r.Column)
+	}
+	if r.Section != "" {
+		where = fmt.Sprintf("%s section %s+0x%x", r.FileType, r.Section, r.SectionOffset)
+	}
+	if r.Address != 0 {
+		where += fmt.Sprintf(" address 0x%x", r.Address)
+	}
+	if r.Symbol != "" {
+		where += fmt.Sprintf(" symbol %s", r.Symbol)
+	}
+	if r.Compression != "" {
+		where += fmt.Sprintf(" compressed by %s", r.Compression)
+	}
+	if r.Commit != "" {
+		where += fmt.Sprintf(" introduced by %.7s %s", r.Commit, r.Author)
+	}
+	if r.Rule != "" {
+		where += fmt.Sprintf(" rule %s(%s %s)", r.Rule, r.Severity, r.Category)
+	}
+	return fmt.Sprintf("%q(%s) matches %s in %s", r.Text, r.Encoding, r.Keyword, where)
+}
+
+type junitTestSuites struct {
+	XMLName xml.Name         `xml:"testsuites"`
+	Suites  []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name      string          `xml:"name,attr"`
+	Tests     int             `xml:"tests,attr"`
+	Failures  int             `xml:"failures,attr"`
+	TestCases []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	ClassName string        `xml:"classname,attr"`
+	Name      string        `xml:"name,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Text    string `xml:",chardata"`
+}
+
+// JUnitResultWriter writes one failing testcase per result.
+// If there is no result, it writes one passing testcase.
+type JUnitResultWriter struct {
+	w       io.Writer
+	mutex   sync.Mutex
+	results []*Result
+}
+
+func (jw *JUnitResultWriter) Write(r *Result) {
+	jw.mutex.Lock()
+	defer jw.mutex.Unlock()
+	jw.results = append(jw.results, r)
+}
+
+func (jw *JUnitResultWriter) Flush() error {
+	jw.mutex.Lock()
+	defer jw.mutex.Unlock()
+
+	suite := junitTestSuite{Name: "cw"}
+	for _, r := range jw.results {
+		suite.TestCases = append(suite.TestCases, junitTestCase{
+			ClassName: r.Path,
+			Name:      strings.TrimSpace(fmt.Sprintf("%s %s %s", r.Section, r.Keyword, r.Text)),
+			Failure: &junitFailure{
+				Message: r.Message(),
+				Text:    csvLine(r.CSVRecord()),
+			},
+		})
+	}
+	suite.Failures = len(suite.TestCases)
+	if len(suite.TestCases) == 0 {
+		suite.TestCases = append(suite.TestCases, junitTestCase{ClassName: "cw", Name: "no new findings"})
+	}
+	suite.Tests = len(suite.TestCases)
+
+	if _, err := io.WriteString(jw.w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(jw.w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(&junitTestSuites{Suites: []junitTestSuite{suite}}); err != nil {
+		return err
+	}
+	_, err := io.WriteString(jw.w, "\n")
+	return err
+}
+
+// ResultCollector keeps all results in memory
+type ResultCollector struct {
+	mutex   sync.Mutex
+	Results []*Result
+}
+
+func (c *ResultCollector) Write(r *Result) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.Results = append(c.Results, r)
+}
+
+func (c *ResultCollector) Flush() error {
+	return nil
+}
+
+type MultiResultWriter []ResultWriter
+
+func (m MultiResultWriter) Write(r *Result) {
+	for _, rw := range m {
+		rw.Write(r)
+	}
+}
+
+func (m MultiResultWriter) Flush() error {
+	for _, rw := range m {
+		if err := rw.Flush(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SerialResultWriter passes results written by concurrent workers
+// to rw through one goroutine, so that lines never interleave.
+// Flush must be called exactly once after all writes.
+type SerialResultWriter struct {
+	ch   chan *Result
+	done chan struct{}
+	rw   ResultWriter
+}
+
+func NewSerialResultWriter(rw ResultWriter) *SerialResultWriter {
+	s := &SerialResultWriter{
+		ch:   make(chan *Result, 64),
+		done: make(chan struct{}),
+		rw:   rw,
+	}
+	go func() {
+		defer close(s.done)
+		for r := range s.ch {
+			s.rw.Write(r)
+		}
+	}()
+	return s
+}
+
+func (s *SerialResultWriter) Write(r *Result) {
+	s.ch <- r
+}
+
+func (s *SerialResultWriter) Flush() error {
+	close(s.ch)
+	<-s.done
+	return s.rw.Flush()
+}
+
+func lessResult(a, b *Result) bool {
+	switch {
+	case a.Path != b.Path:
+		return a.Path < b.Path
+	case a.Offset != b.Offset:
+		return a.Offset < b.Offset
+	case a.Section != b.Section:
+		return a.Section < b.Section
+	case a.Encoding != b.Encoding:
+		return a.Encoding < b.Encoding
+	case a.Keyword != b.Keyword:
+		return a.Keyword < b.Keyword
+	}
+	return a.Text < b.Text
+}
+
+func SortResults(results []*Result) {
+	sort.SliceStable(results, func(i, j int) bool {
+		return lessResult(results[i], results[j])
+	})
+}
+
+// SortedResultWriter buffers results and writes them to rw sorted by path and offset on Flush
+type SortedResultWriter struct {
+	collector ResultCollector
+	rw        ResultWriter
+}
+
+func NewSortedResultWriter(rw ResultWriter) *SortedResultWriter {
+	return &SortedResultWriter{rw: rw}
+}
+
+func (s *SortedResultWriter) Write(r *Result) {
+	s.collector.Write(r)
+}
+
+func (s *SortedResultWriter) Flush() error {
+	results := s.collector.Results
+	SortResults(results)
+	for _, r := range results {
+		s.rw.Write(r)
+	}
+	return s.rw.Flush()
+}